@@ -1,10 +1,14 @@
 package main
  
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"flag"
 	"strconv"
+	"strings"
+	"encoding/hex"
 	"log"
 	//"github.com/boltdb/bolt"
 )
@@ -21,11 +25,35 @@ func(cli *CLI) printUsage() {
 	fmt.Println("Usage:")
 	//fmt.Println("  addblock -data Blockdata")
 	fmt.Println("  printchain //Print all the blocks of the blockchain")
-	fmt.Println("  createwallet //creat a wallet with a pair of key inside")
-	fmt.Println("  getbalance -address ADDRESS  //get the balance from address")
+	fmt.Println("  getblock -height HEIGHT //Print the block at HEIGHT of the main chain")
+	fmt.Println("  getblockcount //Print the height of the best block")
+	fmt.Println("  createwallet [-hd] //creat a wallet with a pair of key inside, -hd turns the wallet into an HD wallet and shows its mnemonic")
+	fmt.Println("  restorewallet -mnemonic \"WORDS\" //Restore an HD wallet from its mnemonic and find its addresses on the chain")
+	fmt.Println("  getbalance -address ADDRESS [-spv -node ADDRESS -port PORT]  //get the balance from address, -spv syncs only block headers from the node and listens on localhost:PORT for its replies")
 	fmt.Println("  listaddresses //Lists all addresses from the wallet file")
-	fmt.Println("  createblockchain -address ADDRESS //creat a chain and the address can get coinbase")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT //address from send amount coin to address to")
+	fmt.Println("  encryptwallet [-passphrase PASSPHRASE] //Encrypt the private keys in the wallet file with a passphrase")
+	fmt.Println("  changepassphrase [-old OLD] [-new NEW] //Change the passphrase of the encrypted wallet")
+	fmt.Println("  createblockchain -address ADDRESS [-txindex] //creat a chain and the address can get coinbase, -txindex keeps an index of all transactions")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT [-fee FEE] [-locktime N] [-lockuntil N | -lockblocks N] [-mine] [-node ADDRESS] //address from send amount coin to address to, the transaction waits in the mempool")
+	fmt.Println("    -locktime: the transaction can not be mined before block height N (or Unix time N if N >= 500000000)")
+	fmt.Println("    -lockuntil: TO can not spend the coins before block height N (or Unix time N if N >= 500000000)")
+	fmt.Println("    -lockblocks: TO can not spend the coins until N blocks after the transaction is mined")
+	fmt.Println("  mine -address ADDRESS //mine a block with the transactions in the mempool, the address gets the reward")
+	fmt.Println("  generate -blocks N -address ADDRESS //regtest only: mine N blocks at once, the address gets the rewards")
+	fmt.Println("  -network NAME anywhere on the command line selects the network: main (default), testnet or regtest, addresses of one network are not valid on another")
+	fmt.Println("  -testnet is short for -network testnet: same rules as main, worthless coins, files in ./testnet, its own address prefixes")
+	fmt.Println("  -regtest is short for -network regtest: minimal difficulty, files in ./regtest, its own address prefixes")
+	fmt.Println("  getpubkey -address ADDRESS //Print the public key of an address in the wallet, used to create multisig addresses")
+	fmt.Println("  createmultisig -m M -pubkeys PUBKEY1,PUBKEY2,... //Create an M of N multisig address and add it to the wallet")
+	fmt.Println("  createmultisigtx -from MULTISIG -to TO -amount AMOUNT [-fee FEE] //Create an unsigned transaction from a multisig address, printed in hex")
+	fmt.Println("  signmultisigtx -tx HEX //Add the signatures of the keys in this wallet to a multisig transaction")
+	fmt.Println("  combinemultisigtx -txs HEX1,HEX2,... //Combine the signatures of the same multisig transaction signed by different wallets")
+	fmt.Println("  sendmultisigtx -tx HEX [-mine ADDRESS] [-node ADDRESS] //Add a multisig transaction with enough signatures to the mempool")
+	fmt.Println("  reindexutxo //Rebuilds the UTXO set")
+	fmt.Println("  reindextx //Rebuilds the transaction index, and enables it if it is not enabled yet")
+	fmt.Println("  getsupply //Print the circulating supply and the reward schedule")
+	fmt.Println("  migratedb //Rewrite the blocks of an old gob encoded database with the binary encoding")
+	fmt.Println("  startnode [-port PORT] [-seed ADDRESS] [-miner ADDRESS] [-rpcport PORT] [-rpcauth USER:PASSWORD] [-txindex] //Start a node on localhost:PORT (the default port of the network if omitted) and sync with the seed node, -rpcport also serves JSON-RPC (authenticated with -rpcauth or the generated rpc.cookie), -txindex enables the transaction index")
 }
  
 //判断命令行参数，如果没有输入参数则显示提示信息
@@ -45,7 +73,7 @@ func (cli *CLI) validateArgs() {
 //打印区块链函数调用
 func (cli *CLI) printChain() {
 	/*var funny int = 0
-	db,err := bolt.Open(dbFile,0600,nil)
+	db,err := bolt.Open(dbFileName(),0600,nil)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -68,20 +96,7 @@ func (cli *CLI) printChain() {
    		for {
     	    block := bci.Next()
 
-			fmt.Printf("============= Block %x ============\n", block.Hash)
-   	 	    fmt.Printf("Timestamp: %d\n", block.Timestamp)
-			fmt.Printf("Prev. hash: %x\n", block.PrevBlockHash)
-			//fmt.Printf("Hash: %x\n", block.Hash)
-    	    //fmt.Printf("Data: %s\n", block.Data)
-    	    pow := NewProofOfWork(block)
-     	   fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-     	   fmt.Println()
-
-			for _,tx := range block.Transactions {
-				transaction := (*tx).String()
-				fmt.Printf("%s\n",transaction)
-			}
-			fmt.Printf("\n\n")
+			printBlock(bc, block)
 			if len(block.PrevBlockHash) == 0 {			
 				break
         	}
@@ -89,27 +104,119 @@ func (cli *CLI) printChain() {
 }	
 //}
 
-//创建一条链
-func (cli *CLI) createBlockchain(address string) {
+//打印一个区块和它的交易
+func printBlock(bc *Blockchain, block *Block) {
+	fmt.Printf("============= Block %x ============\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Version: %d\n", block.Version)
+	fmt.Printf("Timestamp: %d\n", block.Timestamp)
+	fmt.Printf("Prev. hash: %x\n", block.PrevBlockHash)
+	fmt.Printf("Bits: %d\n", block.Bits)
+	//fmt.Printf("Data: %s\n", block.Data)
+	pow := NewProofOfWork(block)
+	fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate(bc.ExpectedBits(block))))
+	fmt.Println()
+
+	for _,tx := range block.Transactions {
+		transaction := (*tx).String()
+		fmt.Printf("%s\n",transaction)
+	}
+	fmt.Printf("\n\n")
+}
+
+//按高度打印主链上的一个区块
+func (cli *CLI) getBlock(height int) {
+	bc := NewBlockchain("")
+	defer bc.Db().Close()
+
+	block, err := bc.GetBlockByHeight(height)
+	if err != nil {
+		fmt.Printf("ERROR: There is no block at height %d, the best height is %d\n", height, bc.GetBestHeight())
+		return
+	}
+	printBlock(bc, &block)
+}
+
+//打印主链顶端区块的高度
+func (cli *CLI) getBlockCount() {
+	bc := NewBlockchain("")
+	defer bc.Db().Close()
+
+	fmt.Println(bc.GetBestHeight())
+}
+
+//创建一条链，txIndex为true时同时开启交易索引
+func (cli *CLI) createBlockchain(address string, txIndex bool) {
 	if !ValidateAddress(address) {
 		fmt.Println(/*log.Panic(*/"ERROR: Address is not valid"/*)*/)
 		return
 	}
 	
 	bc := NewBlockchain(address)
+	if txIndex {
+		bc.ReindexTransactions()
+	}
 	bc.Db().Close()
 	fmt.Println("Done!")
 }
 
 //创建钱包函数
-func (cli *CLI) createWallet() {
+//hd为true并且钱包还不是HD钱包时，先生成助记词把钱包变成HD钱包，之后的地址都由助记词派生
+func (cli *CLI) createWallet(hd bool) {
 	wallets, _ := NewWallets()
+	//新地址的私钥也要用口令加密，所以加密的钱包要先解锁
+	unlockWallets(wallets)
+
+	if hd && !wallets.IsHD() {
+		mnemonic := NewMnemonic()
+		err := wallets.SetMnemonic(mnemonic)
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Your mnemonic: %s\n", mnemonic)
+		fmt.Println("Write it down and keep it safe, it is the backup of every address this wallet creates from now on.")
+		if len(wallets.Wallets) > 0 {
+			fmt.Printf("The %d addresses created before are not covered by the mnemonic, keep backing them up.\n", len(wallets.Wallets))
+		}
+	}
+
 	address := wallets.CreateWallet()
 	wallets.SaveToFile()
 	fmt.Printf("Your new address: %s\n", address)
 }
 
+//用助记词恢复HD钱包，扫描区块链找出用过的地址
+//为了不覆盖已有的私钥，钱包文件已经存在时不恢复
+func (cli *CLI) restoreWallet(mnemonic string) {
+	if _, err := os.Stat(walletFileName()); err == nil {
+		log.Panicf("ERROR: Wallet file %s already exists, move it away before restoring", walletFileName())
+	}
+
+	wallets, _ := NewWallets()
+	err := wallets.SetMnemonic(strings.Join(strings.Fields(mnemonic), " "))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	used := make(map[string]bool)
+	if _, err := os.Stat(dbFileName()); err == nil {
+		bc := NewBlockchain("")
+		used = bc.FindUsedPubKeyHashes()
+		bc.Db().Close()
+	}
+	addresses := wallets.RestoreHD(func(pubKeyHash []byte) bool {
+		return used[hex.EncodeToString(pubKeyHash)]
+	})
+	wallets.SaveToFile()
+
+	for _, address := range addresses {
+		fmt.Println(address)
+	}
+	fmt.Printf("Restored %d addresses. Run encryptwallet to protect the wallet with a passphrase.\n", len(addresses))
+}
+
 //求账户余额（账户余额就是由账户地址锁定的所有未花费交易输出的总和）
+//还不够成熟的coinbase输出暂时不能花费，单独列出来
 func (cli *CLI) getBalance(address string) {
 	if !ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
@@ -118,20 +225,45 @@ func (cli *CLI) getBalance(address string) {
 	bc := NewBlockchain(address)
 	defer bc.Db().Close()
  
-	balance := 0
-
 	pubKeyHash := Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1:len(pubKeyHash)-4]
 	//这里的4是校验位字节数，这里就不在其他包调过来了
 
-	UTXOs := bc.FindUTXO(pubKeyHash)
+	UTXOSet := UTXOSet{bc}
+	mature, immature := UTXOSet.GetBalance(pubKeyHash)
  
-	//遍历UTXOs中的交易输出out，得到输出字段out.Value,求出余额
-	for _,out := range UTXOs {
-		balance += out.Value
+	fmt.Printf("Balance of '%s':%d\n",address,mature+immature)
+	fmt.Printf("  Mature: %d\n",mature)
+	fmt.Printf("  Immature: %d (coinbase outputs need %d confirmations, timelocked outputs wait until unlocked)\n",immature,params.CoinbaseMaturity)
+}
+
+//轻节点模式查询余额：从全节点node同步区块头，再请求地址的交易，用Merkle包含证明验证以后算出余额
+//轻节点在port端口接收全节点的回复，不需要blockchain.db
+func (cli *CLI) getBalanceSPV(address, node, port string) {
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
 	}
- 
-	fmt.Printf("Balance of '%s':%d\n",address,balance)
+
+	client := NewSPVClient(port, node)
+	defer client.Close()
+
+	added, err := client.SyncHeaders()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Synced %d new headers from %s, best height %d\n",added,node,client.BestHeight())
+
+	pubKeyHash := AddressToPubKeyHash(address)
+	transactions, err := client.FetchTransactions([][]byte{pubKeyHash})
+	if err != nil {
+		log.Panic(err)
+	}
+	mature, immature := client.GetBalance(pubKeyHash, transactions)
+
+	fmt.Printf("Balance of '%s':%d\n",address,mature+immature)
+	fmt.Printf("  Mature: %d\n",mature)
+	fmt.Printf("  Immature: %d (coinbase outputs need %d confirmations, timelocked outputs wait until unlocked)\n",immature,params.CoinbaseMaturity)
+	fmt.Printf("  Verified %d transactions against the header chain\n",len(transactions))
 }
 
 //列出地址名单,钱包集合中的地址有哪些
@@ -146,50 +278,495 @@ func (cli *CLI) listAddresses() {
 	}
 }
 
-//之前，我们没有实现挖矿奖励，我们只有在创建区块链的时候coinbaseTX给了奖励，但是之后每一次挖矿都没有给出奖励
-//所以我们要实现每一个区块被挖出后要给矿工一笔挖矿奖励的交易，挖矿奖励实际上就是一笔CoinbaseTX
-//coinbase交易只有一个输出，我们实现挖矿奖励非常简单，把coinbase交易放在区块的Transactions的第一个位置就行了
+//加密钱包，口令没有在命令行给出时从标准输入读取
+func (cli *CLI) encryptWallet(passphrase string) {
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	if wallets.IsEncrypted() {
+		log.Panic(ErrWalletEncrypted)
+	}
+
+	passphrase = readPassphrase("New passphrase: ", passphrase)
+	err = wallets.Encrypt(passphrase)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("Wallet encrypted! Keep the passphrase safe, the coins can not be spent without it.")
+}
+
+//加密的钱包锁定时，签名之前从标准输入读取口令解锁
+//解锁状态只保存在这个进程的内存里，命令结束钱包就又锁定了
+func unlockWallets(wallets *Wallets) {
+	if !wallets.IsLocked() {
+		return
+	}
+
+	err := wallets.Unlock(readPassphrase("Passphrase: ", ""))
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.KeepUnlocked(0)
+}
+
+//修改钱包口令
+func (cli *CLI) changePassphrase(oldPassphrase, newPassphrase string) {
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	if !wallets.IsEncrypted() {
+		log.Panic(ErrWalletNotEncrypted)
+	}
+
+	oldPassphrase = readPassphrase("Old passphrase: ", oldPassphrase)
+	newPassphrase = readPassphrase("New passphrase: ", newPassphrase)
+	err = wallets.ChangePassphrase(oldPassphrase, newPassphrase)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("Passphrase changed!")
+}
+
+//重建UTXO集合
+func (cli *CLI) reindexUTXO() {
+	bc := NewBlockchain("")
+	defer bc.Db().Close()
+
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.Reindex()
+
+	count := UTXOSet.CountTransactions()
+	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+}
+
+//把旧数据库中gob编码的区块改写成新的二进制编码
+func (cli *CLI) migrateDB() {
+	if _, err := os.Stat(dbFileName()); os.IsNotExist(err) {
+		fmt.Println("There is no blockchain database to migrate.")
+		return
+	}
+
+	count, mismatched, err := MigrateDB()
+	if err != nil {
+		log.Panic(err)
+	}
+	if count == 0 {
+		fmt.Println("The database already uses the binary encoding.")
+		return
+	}
+	fmt.Printf("Done! %d blocks are rewritten with the binary encoding.\n", count)
+	for _, hash := range mismatched {
+		fmt.Printf("Warning: block %x can not be verified again with the old rules, other nodes will reject it\n", hash)
+	}
+}
+
+//重建交易索引，还没有交易索引时就开启它
+func (cli *CLI) reindexTx() {
+	bc := NewBlockchain("")
+	defer bc.Db().Close()
+
+	count := bc.ReindexTransactions()
+	fmt.Printf("Done! There are %d transactions in the transaction index.\n", count)
+}
+
+//打印币的发行情况
+//流通量是UTXO集合中所有未花费输出的总和，矿工少领的奖励和手续费不会进入流通，所以它可能小于按规则应发行的量
+func (cli *CLI) getSupply() {
+	bc := NewBlockchain("")
+	defer bc.Db().Close()
+
+	height := bc.GetBestHeight()
+	UTXOSet := UTXOSet{bc}
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Circulating supply: %d\n", UTXOSet.TotalValue())
+	fmt.Printf("Scheduled supply: %d\n", SupplyAtHeight(height))
+	fmt.Printf("Max supply: %d\n", params.MaxSupply)
+	fmt.Printf("Next block subsidy: %d (halving every %d blocks)\n", BlockSubsidy(height+1), params.HalvingInterval)
+}
+
+//启动节点，多个节点在同一台机器上运行时要用NODE_ID环境变量区分各自的数据文件
+//minerAddress不为空时节点是一个矿工，收到交易后会挖出新区块，奖励给minerAddress
+//rpcPort不为空时节点同时提供JSON-RPC服务，节点运行时其他程序通过它查询区块链和使用钱包
+func (cli *CLI) startNode(port, seedAddress, minerAddress, rpcPort, rpcAuth string, txIndex bool) {
+	fmt.Printf("Starting node on port %s\n", port)
+	if txIndex {
+		bc := LoadBlockchain()
+		if !bc.HasTxIndex() {
+			count := bc.ReindexTransactions()
+			fmt.Printf("Transaction index is enabled, %d transactions are indexed\n", count)
+		}
+		bc.Db().Close()
+	}
+	if minerAddress != "" {
+		if !ValidateAddress(minerAddress) {
+			log.Panic("ERROR: Wrong miner address!")
+		}
+		fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+	}
+	if rpcAuth != "" && !strings.Contains(rpcAuth, ":") {
+		log.Panic("ERROR: rpcauth must be USER:PASSWORD")
+	}
+	StartServer(port, seedAddress, minerAddress, rpcPort, rpcAuth)
+}
+
 //send方法
-func (cli *CLI) send(from,to string,amount int) {
+//比特币并不是一连串立刻完成这些事情，而是将所有新的交易放到一个内存池中（mempool），然后当一个矿工准备挖出一个新块时，它就从内存池中取出交易，创建一个候选块
+//只有当包含这些交易的块被挖出来，并添加到区块链以后，里面的交易才开始确认。
+//现在我们也这样做：交易验证通过后放进交易池，由mine命令打包；mineNow为true时马上挖出一个区块
+//node不为空时不放进本地交易池，而是把交易发给该节点
+//fee是付给矿工的手续费，手续费越高的交易越先被打包
+//lockTime、lockOp和lock是交易和付给to的输出的时间锁，见NewUTXOTransaction
+func (cli *CLI) send(from,to string,amount,fee int,lockTime int64,lockOp byte,lock int64,mineNow bool,node string) {
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: Address is not valid")
 	}
 	if !ValidateAddress(to) {
 		log.Panic("ERROR: Address is not valid")
 	}
+	//多重签名地址要由各方签名，见createmultisigtx
+	if IsMultisigAddress(from) {
+		log.Panic("ERROR: Use createmultisigtx to send from a multisig address")
+	}
+	if amount <= 0 || fee < 0 {
+		log.Panic("ERROR: Amount must be positive and fee can not be negative")
+	}
 	
 	//fmt.Println(from)
 
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	unlockWallets(wallets)
+
 	bc := NewBlockchain(from)
 	defer bc.Db().Close()
  
-	tx := NewUTXOTransaction(from,to,amount,bc)
-	//挖出一个包含该交易的区块,此时区块只有这一个交易
-	bc.MineBlock([]*Transaction{tx})
+	UTXOSet := UTXOSet{bc}
+	mempool := NewMempool(bc,true)
+	tx := NewUTXOTransaction(from,to,amount,fee,lockTime,lockOp,lock,&UTXOSet,mempool)
+
+	if node != "" {
+		sendTx(node,tx)
+		fmt.Printf("Transaction %x sent to %s\n",tx.ID,node)
+		return
+	}
+
+	err = mempool.Add(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Transaction %x added to mempool\n",tx.ID)
+
+	if mineNow {
+		//挖出区块的奖励给发送方
+		mineBlock(mempool, from)
+	}
 	fmt.Println("Send success!")
 }
-//比特币并不是一连串立刻完成这些事情（不过我们的实现是这么做的）
-//相反，它会将所有新的交易放到一个内存池中（mempool），然后当一个矿工准备挖出一个新块时，它就从内存池中取出所有的交易，创建一个候选块
-//只有当包含这些交易的块被挖出来，并添加到区块链以后，里面的交易才开始确认。
+
+//显示钱包中一个地址的公钥，创建多重签名地址时要用到各方的公钥
+func (cli *CLI) getPubKey(address string) {
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("ERROR: Address is not in the wallet")
+	}
+	fmt.Printf("%x\n", wallet.PublicKey)
+}
+
+//用m和n个公钥创建多重签名地址，并把脚本加入钱包，这样就可以用这个地址创建交易了
+//公钥的顺序不同地址也不同，各方要用同样的顺序创建
+func (cli *CLI) createMultisig(m int, pubKeys string) {
+	var keys [][]byte
+	for _, key := range strings.Split(pubKeys, ",") {
+		pubKey, err := hex.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			log.Panic(err)
+		}
+		keys = append(keys, pubKey)
+	}
+	script, err := NewMultisigScript(m, keys)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallets, _ := NewWallets()
+	address := wallets.AddMultisig(script)
+	wallets.SaveToFile()
+
+	fmt.Printf("Multisig address (%d of %d): %s\n", m, len(keys), address)
+}
+
+//从多重签名地址from创建一笔还没有签名的交易，以十六进制输出，交给各方签名
+func (cli *CLI) createMultisigTx(from, to string, amount, fee int) {
+	if !ValidateAddress(from) || !IsMultisigAddress(from) {
+		log.Panic("ERROR: Address is not a valid multisig address")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Address is not valid")
+	}
+
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	script, err := wallets.GetMultisig(from)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := NewBlockchain(from)
+	defer bc.Db().Close()
+
+	UTXOSet := UTXOSet{bc}
+	mempool := NewMempool(bc, true)
+	tx := NewMultisigTransaction(script, to, amount, fee, &UTXOSet, mempool)
+
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+//用本钱包中的私钥给多重签名交易签名，输出签名后的交易和每个输入的签名数
+func (cli *CLI) signMultisigTx(txHex string) {
+	tx := decodeTxHex(txHex)
+
+	wallets, err := NewWallets()
+	if err != nil {
+		log.Panic(err)
+	}
+	unlockWallets(wallets)
+
+	bc := NewBlockchain("")
+	defer bc.Db().Close()
+
+	signed := bc.SignMultisigTransaction(&tx, wallets)
+	if signed == 0 {
+		log.Panic("ERROR: The wallet has no key to sign this transaction with")
+	}
+
+	fmt.Printf("%x\n", tx.Serialize())
+	for _, status := range tx.MultisigStatus() {
+		fmt.Println(status)
+	}
+}
+
+//合并几个钱包分别签过名的同一笔多重签名交易
+func (cli *CLI) combineMultisigTx(txHexes string) {
+	var txs []*Transaction
+	for _, txHex := range strings.Split(txHexes, ",") {
+		tx := decodeTxHex(txHex)
+		txs = append(txs, &tx)
+	}
+	tx, err := CombineMultisig(txs)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("%x\n", tx.Serialize())
+	for _, status := range tx.MultisigStatus() {
+		fmt.Println(status)
+	}
+}
+
+//把签名足够的多重签名交易放进交易池，和send一样可以马上挖矿或者发给另一个节点
+//mineNow为true时挖矿奖励给minerAddress
+func (cli *CLI) sendMultisigTx(txHex string, mineNow bool, minerAddress, node string) {
+	tx := decodeTxHex(txHex)
+	if mineNow && !ValidateAddress(minerAddress) {
+		log.Panic("ERROR: Address is not valid")
+	}
+
+	bc := NewBlockchain("")
+	defer bc.Db().Close()
+
+	if !bc.VerifyTransaction(&tx) {
+		log.Panic(ErrNotEnoughMultisig)
+	}
+
+	if node != "" {
+		sendTx(node, &tx)
+		fmt.Printf("Transaction %x sent to %s\n", tx.ID, node)
+		return
+	}
+
+	mempool := NewMempool(bc, true)
+	err := mempool.Add(&tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Transaction %x added to mempool\n", tx.ID)
+
+	if mineNow {
+		mineBlock(mempool, minerAddress)
+	}
+	fmt.Println("Send success!")
+}
+
+//解码命令行中十六进制的交易
+func decodeTxHex(txHex string) Transaction {
+	data, err := hex.DecodeString(strings.TrimSpace(txHex))
+	if err != nil {
+		log.Panic(err)
+	}
+	return DeserializeTransaction(data)
+}
+
+//挖矿：从交易池中取出交易打包进一个新区块，挖矿奖励给address
+func (cli *CLI) mine(address string) {
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+
+	bc := NewBlockchain(address)
+	defer bc.Db().Close()
+
+	mempool := NewMempool(bc,true)
+	newBlock := mineBlock(mempool, address)
+	if newBlock == nil {
+		return
+	}
+	fmt.Printf("Mined block %x with %d transactions, reward %d\n",newBlock.Hash,len(newBlock.Transactions),newBlock.Transactions[0].Vout[0].Value)
+}
+
+//regtest网络上连续挖出n个区块，奖励都给address，交易池中的交易打包进第一个区块
+//还没有区块链时先创建，集成测试可以用它很快地建出一条很长的链
+func (cli *CLI) generate(n int, address string) {
+	if params != &RegTestParams {
+		log.Panic("ERROR: generate is only available with -regtest")
+	}
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+
+	bc := NewBlockchain(address)
+	defer bc.Db().Close()
+
+	mempool := NewMempool(bc,true)
+	for i := 0; i < n; i++ {
+		if mineBlock(mempool, address) == nil {
+			return
+		}
+	}
+	fmt.Printf("Generated %d blocks, best height %d\n",n,bc.GetBestHeight())
+}
+
+//把交易池中的交易打包挖出一个新区块，挖矿时按Ctrl-C放弃，交易留在交易池里，返回nil
+func mineBlock(mempool *Mempool, address string) *Block {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	newBlock, err := mempool.Mine(ctx, address)
+	if err != nil {
+		fmt.Printf("Mining aborted: %s, transactions stay in the mempool\n", err)
+		return nil
+	}
+
+	return newBlock
+}
 
 //入口函数
 func (cli *CLI) Run() {
+	//-network NAME、-testnet和-regtest可以放在命令行的任何位置，选好网络以后去掉它们再按命令解析
+	var args []string
+	network := ""
+	for i := 0; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		switch {
+		case arg == "-testnet" || arg == "--testnet":
+			network = TestNetParams.Name
+		case arg == "-regtest" || arg == "--regtest":
+			network = RegTestParams.Name
+		case (arg == "-network" || arg == "--network") && i+1 < len(os.Args):
+			i++
+			network = os.Args[i]
+		case strings.HasPrefix(arg, "-network=") || strings.HasPrefix(arg, "--network="):
+			network = arg[strings.Index(arg, "=")+1:]
+		default:
+			args = append(args, arg)
+		}
+	}
+	os.Args = args
+	if network != "" {
+		selectNetwork(network)
+	}
+
 	//判断命令行输入参数的个数，如果没有输入任何参数则打印提示输入参数信息
 	cli.validateArgs()
 	//实例化flag集合
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	restoreWalletCmd := flag.NewFlagSet("restorewallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getBlockCountCmd := flag.NewFlagSet("getblockcount", flag.ExitOnError)
+	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+	encryptWalletCmd := flag.NewFlagSet("encryptwallet", flag.ExitOnError)
+	changePassphraseCmd := flag.NewFlagSet("changepassphrase", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	createMultisigTxCmd := flag.NewFlagSet("createmultisigtx", flag.ExitOnError)
+	signMultisigTxCmd := flag.NewFlagSet("signmultisigtx", flag.ExitOnError)
+	combineMultisigTxCmd := flag.NewFlagSet("combinemultisigtx", flag.ExitOnError)
+	sendMultisigTxCmd := flag.NewFlagSet("sendmultisigtx", flag.ExitOnError)
 
 	//注册flag标志符
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
-	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	getBalanceSPV := getBalanceCmd.Bool("spv", false, "Light client mode: sync only block headers from -node and verify the transactions with Merkle proofs")
+	getBalanceNode := getBalanceCmd.String("node", "", "The full node the light client syncs with, e.g. localhost:3000")
+	getBalancePort := getBalanceCmd.String("port", "", "The port the light client listens on for the replies of the full node")
+	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send the reward of the first block after the genesis block to")
+	createBlockchainTxIndex := createBlockchainCmd.Bool("txindex", false, "Keep an index of all transactions")
+	createWalletHD := createWalletCmd.Bool("hd", false, "Derive addresses from a mnemonic seed")
+	restoreWalletMnemonic := restoreWalletCmd.String("mnemonic", "", "The mnemonic shown when the HD wallet was created")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendMine := sendCmd.Bool("mine", false, "Mine a block immediately")
+	sendNode := sendCmd.String("node", "", "Send the transaction to this node instead of the local mempool")
+	sendLockTime := sendCmd.Int64("locktime", 0, "The transaction can not be mined before this block height or Unix time")
+	sendLockUntil := sendCmd.Int64("lockuntil", 0, "The output to TO can not be spent before this block height or Unix time")
+	sendLockBlocks := sendCmd.Int64("lockblocks", 0, "The output to TO can not be spent until this many blocks after it is mined")
+	mineAddress := mineCmd.String("address", "", "The address to send mining reward to")
+	generateBlocks := generateCmd.Int("blocks", 1, "Number of blocks to mine")
+	generateAddress := generateCmd.String("address", "", "The address to send mining rewards to")
+	startNodePort := startNodeCmd.String("port", "", "The port the node listens on, the default port of the network if omitted")
+	startNodeSeed := startNodeCmd.String("seed", "", "Address of a known node to sync with, e.g. localhost:3000")
+	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to this address")
+	startNodeRPCPort := startNodeCmd.String("rpcport", "", "Serve JSON-RPC on localhost:RPCPORT")
+	startNodeRPCAuth := startNodeCmd.String("rpcauth", "", "USER:PASSWORD required by the JSON-RPC server (HTTP basic auth)")
+	startNodeTxIndex := startNodeCmd.Bool("txindex", false, "Build the transaction index if it is not enabled yet")
+	encryptWalletPassphrase := encryptWalletCmd.String("passphrase", "", "The passphrase to encrypt the wallet with, read from stdin if not given")
+	getBlockHeight := getBlockCmd.Int("height", -1, "Height of the block in the main chain")
+	changePassphraseOld := changePassphraseCmd.String("old", "", "The current passphrase, read from stdin if not given")
+	changePassphraseNew := changePassphraseCmd.String("new", "", "The new passphrase, read from stdin if not given")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "The address in the wallet")
+	createMultisigM := createMultisigCmd.Int("m", 0, "Number of signatures required")
+	createMultisigPubKeys := createMultisigCmd.String("pubkeys", "", "Comma separated public keys in hex, see getpubkey")
+	createMultisigTxFrom := createMultisigTxCmd.String("from", "", "Source multisig address")
+	createMultisigTxTo := createMultisigTxCmd.String("to", "", "Destination wallet address")
+	createMultisigTxAmount := createMultisigTxCmd.Int("amount", 0, "Amount to send")
+	createMultisigTxFee := createMultisigTxCmd.Int("fee", 0, "Fee paid to the miner")
+	signMultisigTxTx := signMultisigTxCmd.String("tx", "", "The transaction in hex")
+	combineMultisigTxTxs := combineMultisigTxCmd.String("txs", "", "Comma separated transactions in hex")
+	sendMultisigTxTx := sendMultisigTxCmd.String("tx", "", "The transaction in hex")
+	sendMultisigTxMine := sendMultisigTxCmd.String("mine", "", "Mine a block immediately and send the reward to this address")
+	sendMultisigTxNode := sendMultisigTxCmd.String("node", "", "Send the transaction to this node instead of the local mempool")
 
 	switch os.Args[1] {		//os.Args为一个保存输入命令的切片
 	case "getbalance":
@@ -207,6 +784,11 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "restorewallet":
+		err := restoreWalletCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -217,11 +799,96 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getblock":
+		err := getBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getblockcount":
+		err := getBlockCountCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "reindexutxo":
+		err := reindexUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindextx":
+		err := reindexTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "startnode":
+		err := startNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "mine":
+		err := mineCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "generate":
+		err := generateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "migratedb":
+		err := migrateDBCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "encryptwallet":
+		err := encryptWalletCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "changepassphrase":
+		err := changePassphraseCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisigtx":
+		err := createMultisigTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signmultisigtx":
+		err := signMultisigTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "combinemultisigtx":
+		err := combineMultisigTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendmultisigtx":
+		err := sendMultisigTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
@@ -233,7 +900,15 @@ func (cli *CLI) Run() {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress)
+		if *getBalanceSPV {
+			if *getBalanceNode == "" || *getBalancePort == "" {
+				getBalanceCmd.Usage()
+				os.Exit(1)
+			}
+			cli.getBalanceSPV(*getBalanceAddress, *getBalanceNode, *getBalancePort)
+		} else {
+			cli.getBalance(*getBalanceAddress)
+		}
 	}
  
 	if createBlockchainCmd.Parsed() {
@@ -242,11 +917,19 @@ func (cli *CLI) Run() {
 			os.Exit(1)
 		}
 		//fmt.Println(*createBlockchainAddress,"!!!!!")
-		cli.createBlockchain(*createBlockchainAddress)
+		cli.createBlockchain(*createBlockchainAddress, *createBlockchainTxIndex)
 	}
  
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		cli.createWallet(*createWalletHD)
+	}
+
+	if restoreWalletCmd.Parsed() {
+		if *restoreWalletMnemonic == "" {
+			restoreWalletCmd.Usage()
+			os.Exit(1)
+		}
+		cli.restoreWallet(*restoreWalletMnemonic)
 	}
 
 	if listAddressesCmd.Parsed() {
@@ -256,12 +939,129 @@ func (cli *CLI) Run() {
 	if printChainCmd.Parsed() {
 		cli.printChain()
 	}
+
+	if getBlockCmd.Parsed() {
+		if *getBlockHeight < 0 {
+			getBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getBlock(*getBlockHeight)
+	}
+
+	if getBlockCountCmd.Parsed() {
+		cli.getBlockCount()
+	}
+
+	if reindexUTXOCmd.Parsed() {
+		cli.reindexUTXO()
+	}
+
+	if reindexTxCmd.Parsed() {
+		cli.reindexTx()
+	}
+
+	if startNodeCmd.Parsed() {
+		if *startNodePort == "" {
+			*startNodePort = params.DefaultPort
+		}
+		cli.startNode(*startNodePort, *startNodeSeed, *startNodeMiner, *startNodeRPCPort, *startNodeRPCAuth, *startNodeTxIndex)
+	}
+
+	if mineCmd.Parsed() {
+		if *mineAddress == "" {
+			mineCmd.Usage()
+			os.Exit(1)
+		}
+		cli.mine(*mineAddress)
+	}
+
+	if generateCmd.Parsed() {
+		if *generateAddress == "" || *generateBlocks <= 0 {
+			generateCmd.Usage()
+			os.Exit(1)
+		}
+		cli.generate(*generateBlocks, *generateAddress)
+	}
+
+	if getSupplyCmd.Parsed() {
+		cli.getSupply()
+	}
+
+	if migrateDBCmd.Parsed() {
+		cli.migrateDB()
+	}
+
+	if encryptWalletCmd.Parsed() {
+		cli.encryptWallet(*encryptWalletPassphrase)
+	}
+
+	if changePassphraseCmd.Parsed() {
+		cli.changePassphrase(*changePassphraseOld, *changePassphraseNew)
+	}
+
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getPubKey(*getPubKeyAddress)
+	}
+
+	if createMultisigCmd.Parsed() {
+		if *createMultisigM <= 0 || *createMultisigPubKeys == "" {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*createMultisigM, *createMultisigPubKeys)
+	}
+
+	if createMultisigTxCmd.Parsed() {
+		if *createMultisigTxFrom == "" || *createMultisigTxTo == "" || *createMultisigTxAmount <= 0 || *createMultisigTxFee < 0 {
+			createMultisigTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisigTx(*createMultisigTxFrom, *createMultisigTxTo, *createMultisigTxAmount, *createMultisigTxFee)
+	}
+
+	if signMultisigTxCmd.Parsed() {
+		if *signMultisigTxTx == "" {
+			signMultisigTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signMultisigTx(*signMultisigTxTx)
+	}
+
+	if combineMultisigTxCmd.Parsed() {
+		if *combineMultisigTxTxs == "" {
+			combineMultisigTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.combineMultisigTx(*combineMultisigTxTxs)
+	}
+
+	if sendMultisigTxCmd.Parsed() {
+		if *sendMultisigTxTx == "" {
+			sendMultisigTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.sendMultisigTx(*sendMultisigTxTx, *sendMultisigTxMine != "", *sendMultisigTxMine, *sendMultisigTxNode)
+	}
  
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime < 0 ||
+			*sendLockUntil < 0 || *sendLockBlocks < 0 || *sendLockBlocks >= lockTimeThreshold ||
+			(*sendLockUntil > 0 && *sendLockBlocks > 0) {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		var lockOp byte
+		lock := int64(0)
+		if *sendLockUntil > 0 {
+			lockOp, lock = OP_CHECKLOCKTIMEVERIFY, *sendLockUntil
+		}
+		if *sendLockBlocks > 0 {
+			lockOp, lock = OP_CHECKSEQUENCEVERIFY, *sendLockBlocks
+		}
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendLockTime, lockOp, lock, *sendMine, *sendNode)
 	}
 }
\ No newline at end of file
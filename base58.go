@@ -18,7 +18,8 @@ func Base58Encode(input []byte) []byte {
 		result = append(result, b58Alphabet[mod.Int64()])
 	}
 	ReverseBytes(result)
-	for b := range input {
+	//开头的每个0字节编码成一个'1'
+	for _, b := range input {
 		if b == 0x00 {
 			result = append([]byte{b58Alphabet[0]}, result...)
 		} else {
@@ -32,9 +33,12 @@ func Base58Encode(input []byte) []byte {
 func Base58Decode(input []byte) []byte {
 	result := big.NewInt(0)
 	zeroBytes := 0
-	for b := range input {
-		if b == 0x00 {
+	//开头的每个'1'解码成一个0字节
+	for _, b := range input {
+		if b == b58Alphabet[0] {
 			zeroBytes++
+		} else {
+			break
 		}
 	}
 	payload := input[zeroBytes:]
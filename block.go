@@ -1,56 +1,104 @@
 package main
 
 import (
-	"encoding/gob"
 	"bytes"
 	"log"
-    "crypto/sha256"
+	"errors"
 )
 
 //区块的结构体
 type Block struct {
+    Version       int//区块的编码版本，见encoding.go，gob编码时期的旧区块是0
     Timestamp     int64//当前时间戳，即区块创建时间
     //Data          []byte//存储的信息
     Transactions  []*Transaction//交易，这里用的是数组，也就是说一个块能存多个交易
     PrevBlockHash []byte//前一个块的哈希
     Hash          []byte//当前块哈希
 	Nonce         int//Nonce
+	Height        int//区块高度，创世块为0，难度调整时需要知道区块在链中的位置
+	Bits          int//该区块的难度，即哈希值前面需要多少个0位
 }
 
-//我们想要通过仅仅一个哈希，就可以识别一个块里面的所有交易。为此，我们获得每笔交易的哈希，将它们关联起来，然后获得一个连接后的组合哈希
+//我们想要通过仅仅一个哈希，就可以识别一个块里面的所有交易
+//比特币使用了一个更加复杂的技术：它将一个块里面包含的所有交易表示为一个 Merkle tree ，然后在工作量证明系统中使用树的根哈希（root hash）
+//这个方法能够让我们快速检索一个块里面是否包含了某笔交易，即只需 root hash 而无需下载所有交易即可完成判断。
+//我们也这样做：用每笔交易计算ID时的数据作为叶子构建 Merkle 树，返回树的根哈希
 func (b *Block) HashTransactions() []byte {
-	var txHash [32]byte
-	var txHashes [][]byte
+	mTree := b.merkleTree()
+
+	return mTree.RootNode.Data
+}
+
+//用区块中的交易构建Merkle树
+func (b *Block) merkleTree() *MerkleTree {
+	var transactions [][]byte
 	for _,tx := range b.Transactions {
-		txHashes = append(txHashes,tx.Hash())
+		transactions = append(transactions,tx.hashData())
 	}
-	txHash = sha256.Sum256(bytes.Join(txHashes,[]byte{}))
- 
-	return txHash[:]
+
+	return NewMerkleTree(transactions)
 }
-//比特币使用了一个更加复杂的技术：它将一个块里面包含的所有交易表示为一个 Merkle tree ，然后在工作量证明系统中使用树的根哈希（root hash）
-//这个方法能够让我们快速检索一个块里面是否包含了某笔交易，即只需 root hash 而无需下载所有交易即可完成判断。
 
-//实现 Block 的序列化方法（把块变成能存进数据库的字符串）
-func (b *Block) Serialize() []byte {
-    var result bytes.Buffer//定义一个 buffer 存储序列化之后的数据
-    //初始化一个 gob encoder 并对 block 进行编码
-    encoder := gob.NewEncoder(&result)
-    err := encoder.Encode(b)
-    if err != nil {
-		log.Panic(err)
+//为区块中ID为txID的交易生成Merkle包含证明
+//轻节点拿到这个证明和交易本身，再加上区块的Merkle根，就能确认交易在这个区块里
+func (b *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
+	for index,tx := range b.Transactions {
+		if bytes.Compare(tx.ID,txID) == 0 {
+			hashes,err := b.merkleTree().Proof(index)
+			if err != nil {
+				return nil,err
+			}
+			return &MerkleProof{txID,index,hashes},nil
+		}
 	}
-    return result.Bytes()//结果作为一个字节数组返回
+
+	return nil,errors.New("Transaction is not found in block")
+}
+
+//实现 Block 的序列化方法（把块变成能存进数据库和在网络上传输的字节），格式见encoding.go
+func (b *Block) Serialize() []byte {
+    e := &encoder{}
+    e.blockHeader(b.Header(),b.Nonce)
+    e.bytes(b.Hash)
+    e.uint32(uint32(len(b.Transactions)))
+    for _,tx := range b.Transactions {
+        e.bytes(tx.Serialize())
+    }
+    return e.buf.Bytes()
+}
+
+//区块头的编码，版本1的区块挖矿时就是对它做哈希
+func (b *Block) SerializeHeader() []byte {
+    return b.Header().Serialize()
 }
  
-//解序列化的函数（把数据库里的字符串解出来）
+//解序列化的函数（把数据库里的字节解出来）
 func DeserializeBlock(d []byte) *Block {
-    var block Block
-
-    decoder := gob.NewDecoder(bytes.NewReader(d))
-    err := decoder.Decode(&block)
+    block,err := decodeBlock(d)
     if err != nil {
 		log.Panic(err)
 	}
-    return &block
-}
\ No newline at end of file
+    return block
+}
+
+//解码区块，数据不完整或有多余的数据时返回错误
+//区块头中的Merkle根不保存在Block里，需要时由交易重新算出
+func decodeBlock(data []byte) (*Block, error) {
+    var header BlockHeader
+
+    d := &decoder{data: data}
+    d.blockHeader(&header)
+    block := Block{header.Version, header.Timestamp, nil, header.PrevBlockHash, d.bytes(), header.Nonce, header.Height, header.Bits}
+    n := d.count(4)
+    for i := 0; i < n && d.err == nil; i++ {
+        tx,err := decodeTransaction(d.bytes())
+        if d.err == nil && err != nil {
+            return nil,err
+        }
+        block.Transactions = append(block.Transactions,tx)
+    }
+    if err := d.finish(); err != nil {
+        return nil,err
+    }
+    return &block,nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/boltdb/bolt"
 	"log"
 	"encoding/hex"
@@ -8,29 +9,87 @@ import (
 	"crypto/ecdsa"
 	"errors"
 	"fmt"
+	"os"
+	"time"
 )
 
-const dbFile = "blockchain.db"
+//在同一台机器上运行多个节点时，用环境变量NODE_ID区分每个节点各自的数据库文件
+//没有设置NODE_ID时还是使用原来的blockchain.db
+func dbFileName() string {
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		return dataFile(params.DBFile)
+	}
+	return dataFile(fmt.Sprintf("blockchain_%s.db", nodeID))
+}
 
 const blocksBucket = "blocks"
 
-//创世块中的信息
-const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
 //区块链
 type Blockchain struct {
     tip []byte
     db  *bolt.DB
+    tipChanged chan struct{}//顶端区块变化时被关闭，然后换成一个新的channel
 }
 
+//挖矿期间顶端区块变了，正在挖的区块已经过时
+var ErrTipChanged = errors.New("Tip of the chain changed while mining")
+
 //工厂模式db
 func(bc *Blockchain) Db() *bolt.DB {
 	return bc.db
 }
  
-//把区块添加进区块链,挖矿
-func (bc *Blockchain) MineBlock(transactions []*Transaction) {
+//把区块添加进区块链,挖矿，返回挖出的新区块
+//ctx被取消或者挖矿期间顶端区块变了就放弃，返回原因，顶端变了时是ErrTipChanged
+func (bc *Blockchain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	tipChanged := bc.TipChanged()
+	candidate := bc.NewCandidateBlock(transactions)
+	err := candidate.MineOnTip(ctx, tipChanged)
+	if err != nil {
+		return nil, err
+	}
+	err = bc.SubmitBlock(candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	return candidate, nil
+}
+
+//返回一个在顶端区块变化时会被关闭的channel，挖矿时用它发现自己正在挖的区块过时了
+//和修改区块链一样，节点里要拿到serverLock才能调用
+func (bc *Blockchain) TipChanged() <-chan struct{} {
+	return bc.tipChanged
+}
+
+//设置新的顶端区块，通知正在等待顶端变化的矿工
+func (bc *Blockchain) setTip(hash []byte) {
+	bc.tip = hash
+	close(bc.tipChanged)
+	bc.tipChanged = make(chan struct{})
+}
+
+//对候选区块做工作量证明，tipChanged被关闭（顶端区块变了）时放弃并返回ErrTipChanged
+func (b *Block) MineOnTip(ctx context.Context, tipChanged <-chan struct{}) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-tipChanged:
+			cancel(ErrTipChanged)
+		case <-ctx.Done():
+		}
+	}()
+
+	return b.Mine(ctx)
+}
+
+//把交易打包成一个接在顶端区块后面的候选区块，还没有做工作量证明
+func (bc *Blockchain) NewCandidateBlock(transactions []*Transaction) *Block {
 	var lastHash []byte
+	var lastBlock *BlockHeader
 
 	//在一笔交易被放入一个块之前进行验证
 	for _, tx := range transactions {
@@ -38,11 +97,11 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) {
 			log.Panic("ERROR: Invalid transaction")
 		}
 	}
-
 	//只读的方式浏览数据库，获取当前区块链顶端区块的哈希，为加入下一区块做准备
 	err := bc.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		lastHash = b.Get([]byte("l"))	//通过键"l"拿到区块链顶端区块哈希
+		lastBlock = getHeader(tx, lastHash) //新区块的高度和难度要根据顶端区块算出来
  
 		return nil
 	})
@@ -50,27 +109,46 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) {
 		log.Panic(err)
 	}
  
+	//矿工领取的奖励不能超过 新区块高度的挖矿奖励+手续费
+	err = bc.VerifyCoinbase(transactions,lastBlock.Height+1)
+	if err != nil {
+		log.Panic(err)
+	}
+ 
 	//prevBlock := bc.Blocks[len(bc.Blocks)-1]
-	//求出新区块
-	newBlock := NewBlock(transactions,lastHash)
+	return newCandidateBlock(transactions,lastHash,lastBlock.Height+1,bc.CalculateNextBits(lastBlock))
+}
+
+//把挖出的候选区块加入区块链，挖矿期间顶端区块变了就返回ErrTipChanged
+func (bc *Blockchain) SubmitBlock(newBlock *Block) error {
+	if bytes.Compare(newBlock.PrevBlockHash, bc.tip) != 0 {
+		return ErrTipChanged
+	}
 	// bc.Blocks = append(bc.Blocks,newBlock)
-	//把新区块加入到数据库区块链中
-	err = bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash,newBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
-		err = b.Put([]byte("l"),newBlock.Hash)
-		bc.tip = newBlock.Hash
- 
-		return nil
-	})
+	//把新区块加入到数据库区块链中，它接在顶端区块后面，累计工作量一定最大，会成为新的顶端，UTXO集合也一并更新
+	bc.storeBlock(newBlock)
+	err := bc.activateBestChain(newBlock)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return nil
 }
 
-//创建创世块
-func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase},[]byte{})
+//把当前网络固定的创世块写进空的数据库，成为顶端区块
+func storeGenesisBlock(tx *bolt.Tx, b *bolt.Bucket) []byte {
+	genesis := params.GenesisBlock()
+	err := b.Put(genesis.Hash, genesis.Serialize()) //写入键值对，区块哈希对应序列化后的区块
+	if err != nil {
+		log.Panic(err)
+	}
+	err = b.Put([]byte("l"),genesis.Hash) //"l"键对应区块链顶端区块的哈希
+	if err != nil {
+		log.Panic(err)
+	}
+	putHeader(tx, genesis.Hash, genesis.Header())
+
+	return genesis.Hash
 }
 
 /*新的创建区块链的函数
@@ -80,16 +158,17 @@ func NewGenesisBlock(coinbase *Transaction) *Block {
 （1） 创建一个新的 Blockchain 实例
 （2） 设置 Blockchain 实例的 tip 为数据库中存储的最后一个块的哈希
 4.	如果没有区块链：
-（1） 创建创世块
-（2） 存储到数据库
-（3） 将创世块哈希保存为最后一个块的哈希
-（4） 创建一个新的 Blockchain 实例，其 tip 指向创世块（tip 有尾部，尖端的意思，在这里 tip 存储的是最后一个块的哈希
+（1） 把网络固定的创世块存储到数据库（见ChainParams.GenesisBlock）
+（2） 将创世块哈希保存为最后一个块的哈希
+（3） 创建一个新的 Blockchain 实例，其 tip 指向创世块（tip 有尾部，尖端的意思，在这里 tip 存储的是最后一个块的哈希
+（4） 创世块的奖励谁也花不了，address不为空时接着挖出高度1的区块，奖励给address
 */
 func NewBlockchain(address string) *Blockchain {
 	//return &Blockchain{[]*block.Block{GenesisBlock()}}
 	var tip []byte
+	created := false
 	//打开一个数据库文件，如果文件不存在则创建该名字的文件
-	db,err := bolt.Open(dbFile,0600,nil)
+	db,err := bolt.Open(dbFileName(),0600,nil)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -101,35 +180,207 @@ func NewBlockchain(address string) *Blockchain {
 			//不存在则从头 创建
 			//fmt.Println(address,"!!!!!!")
 			fmt.Println("There is no blockchain.Let's create one!")
-			cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
-        	genesis := NewGenesisBlock(cbtx)//创建创世区块
 			b, err := tx.CreateBucket([]byte(blocksBucket)) //创建名为blocksBucket的桶
 			if err != nil {
 				log.Panic(err)
 			}
-			err = b.Put(genesis.Hash, genesis.Serialize()) //写入键值对，区块哈希对应序列化后的区块
-			if err != nil {
-				log.Panic(err)
-			}
-			err = b.Put([]byte("l"),genesis.Hash) //"l"键对应区块链顶端区块的哈希
-			if err != nil {
-				log.Panic(err)
-			}
-			tip = genesis.Hash //指向最后一个区块，这里也就是创世区块
+			checkDBFormat(b) //新建的链直接使用新的区块编码
+			tip = storeGenesisBlock(tx, b) //指向最后一个区块，这里也就是创世区块
+			created = true
 		} else {
 			//如果存在blocksBucket桶，也就是存在区块链
 			//通过键"l"映射出顶端区块的Hash值
+			checkDBFormat(b)
 			tip = b.Get([]byte("l"))
+			indexHeaders(tx)
+		}
+		//新创建的链，或者是还没有高度索引的旧数据库，都在这里建立高度索引
+		if tip != nil {
+			updateHeightIndex(tx, tip)
 		}
  
 		return nil
 	})
+	if err != nil {
+		log.Panic(err)
+	}
  
-	bc := Blockchain{tip,db}  //此时Blockchain结构体字段已经变成这样了
+	bc := Blockchain{tip,db,make(chan struct{})}  //此时Blockchain结构体字段已经变成这样了
+
+	//新创建的链，或者是还没有UTXO集合（或者UTXO集合是旧格式）的旧数据库，都需要先建立一次UTXO集合
+	if !bc.hasUTXOSet() {
+		UTXOSet := UTXOSet{&bc}
+		UTXOSet.Reindex()
+	}
+
+	if created && address != "" {
+		_, err := bc.MineBlock(context.Background(), []*Transaction{NewCoinbaseTX(address, "", 1, 0)})
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
 	return &bc
  
 }
  
+//打开节点的区块链，和NewBlockchain不同的是，如果还没有区块链只写入网络固定的创世块
+//之后的区块等待从其他节点同步
+func LoadBlockchain() *Blockchain {
+	var tip []byte
+	db,err := bolt.Open(dbFileName(),0600,nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b,err := tx.CreateBucketIfNotExists([]byte(blocksBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		checkDBFormat(b)
+		indexHeaders(tx)
+		tip = b.Get([]byte("l"))
+		if tip == nil {
+			tip = storeGenesisBlock(tx, b)
+		}
+		updateHeightIndex(tx, tip)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := Blockchain{tip,db,make(chan struct{})}
+	if !bc.hasUTXOSet() {
+		UTXOSet := UTXOSet{&bc}
+		UTXOSet.Reindex()
+	}
+
+	return &bc
+}
+
+//把从其他节点收到的区块验证后保存到区块链中
+//不在主链上的分支区块也会被保存下来，一旦某条分支的累计工作量超过了主链，就切换到这条分支
+//区块头、难度、时间戳和coinbase在保存之前检查，交易的输入和签名要等区块被连接到UTXO集合时才能检查
+//区块无效时返回BlockValidationError；已经有这个区块或者还没有它的父区块时返回ErrBlockKnown或ErrOrphanBlock
+func (bc *Blockchain) AddBlock(block *Block) error {
+	if _, err := bc.GetBlock(block.Hash); err == nil {
+		return ErrBlockKnown
+	}
+
+	err := bc.checkBlock(block)
+	if err != nil {
+		return err
+	}
+
+	if !bc.storeBlock(block) {
+		return ErrBlockKnown
+	}
+
+	return bc.activateBestChain(block)
+}
+
+//返回顶端区块的高度，空链返回-1
+//高度索引中最大的高度就是顶端区块的高度
+func (bc *Blockchain) GetBestHeight() int {
+	height := -1
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(heightBucket))
+		if b == nil {
+			return nil
+		}
+		k, _ := b.Cursor().Last()
+		if k != nil {
+			height = heightFromKey(k)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return height
+}
+
+//主链上创世块的哈希，旧版本创建的链的创世块和网络固定的创世块不一样
+func (bc *Blockchain) GenesisHash() []byte {
+	var hash []byte
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(heightBucket))
+		if b != nil {
+			hash = append([]byte{}, b.Get(heightKey(0))...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return hash
+}
+
+//通过高度找到主链上的一个区块
+func (bc *Blockchain) GetBlockByHeight(height int) (Block,error) {
+	var hash []byte
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(heightBucket))
+		if b != nil {
+			hash = b.Get(heightKey(height))
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if hash == nil {
+		return Block{},errors.New("Block is not found")
+	}
+
+	return bc.GetBlock(hash)
+}
+
+//返回链中所有区块的哈希，从顶端区块到创世块
+func (bc *Blockchain) GetBlockHashes() [][]byte {
+	var blocks [][]byte
+	if len(bc.tip) == 0 {
+		return blocks
+	}
+
+	bci := bc.HeaderIterator()
+	for {
+		hash, header := bci.Next()
+		blocks = append(blocks,hash)
+
+		if len(header.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	return blocks
+}
+
+//判断数据库里是否已经有当前格式的UTXO集合，格式见utxoFormat
+func (bc *Blockchain) hasUTXOSet() bool {
+	exists := false
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		exists = tx.Bucket([]byte(utxoBucket)) != nil && b != nil && string(b.Get(utxoFormatKey)) == utxoFormat
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return exists
+}
+
 //为了防止区块链数据太大，我们一个一个地用区块链迭代器读取
 type BlockchainIterator struct {
     currentHash []byte
@@ -167,22 +418,55 @@ func (i *BlockchainIterator) Next() *Block {
     return block
 }
 
+//通过区块哈希找到一个区块
+func (bc *Blockchain) GetBlock(blockHash []byte) (Block,error) {
+	var block Block
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		blockData := b.Get(blockHash)
+		if blockData == nil {
+			return errors.New("Block is not found")
+		}
+		block = *DeserializeBlock(blockData)
+
+		return nil
+	})
+	if err != nil {
+		return block,err
+	}
+
+	return block,nil
+}
+
 //通过交易ID找到一个交易
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction,error) {
+	tx,_,err := bc.FindTransactionBlock(ID)
+	return tx,err
+}
+
+//通过交易ID找到主链上的一个交易和它所在的区块
+//开启了交易索引时直接查索引，否则从顶端区块往回逐个区块查找
+func (bc *Blockchain) FindTransactionBlock(ID []byte) (Transaction,Block,error) {
+	tx,block,err := bc.findIndexedTransaction(ID)
+	if err != errNoTxIndex {
+		return tx,block,err
+	}
+
 	bci := bc.Iterator()
 	for {
 		block := bci.Next()
 
 		for _,tx := range block.Transactions {
 			if bytes.Compare(tx.ID,ID) == 0 {
-				return *tx,nil
+				return *tx,*block,nil
 			}
 		}
 		if len(block.PrevBlockHash) == 0 {
 			break
 		}
 	}
-	return Transaction{},errors.New("Transaction is not found")
+	return Transaction{},Block{},errors.New("Transaction is not found")
 }
 
 //对交易输入进行签名
@@ -199,104 +483,264 @@ func (bc *Blockchain) SignTransaction(tx *Transaction,privKey ecdsa.PrivateKey)
 	tx.Sign(privKey,prevTXs)
 }
 
-//验证交易
+//验证交易，交易按将要放进下一个区块来检查
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
+	//coinbase 交易没有引用之前的输出，也没有签名
+	if tx.IsCoinbase() {
+		return true
+	}
+
 	prevTXs := make(map[string]Transaction)
+	prevHeights := make(map[string]int)
  
 	for _, vin := range tx.Vin {
-		prevTX,err := bc.FindTransaction(vin.Txid)
+		prevTX,block,err := bc.FindTransactionBlock(vin.Txid)
 		if err != nil {
 			log.Panic(err)
 		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		prevHeights[hex.EncodeToString(prevTX.ID)] = block.Height
 	}
-	return tx.Verify(prevTXs) //验证签名
+	return tx.Verify(prevTXs, prevHeights, bc.GetBestHeight()+1, time.Now().Unix()) //验证解锁脚本
 }
 
-//找到包含未花费输出的交易
-//未花费交易输出（unspent transactions outputs, UTXO）
-func (bc *Blockchain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
-	var unspentTXs []Transaction
-	spentTXOs := make(map[string][]int)
+//计算一笔交易的手续费，也就是输入总额减去输出总额，coinbase交易没有手续费
+func (bc *Blockchain) TransactionFee(tx *Transaction) (int,error) {
+	if tx.IsCoinbase() {
+		return 0,nil
+	}
+
+	inputValue := 0
+	for _,vin := range tx.Vin {
+		prevTX,err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			return 0,err
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return 0,errors.New("Transaction input refers to a nonexistent output")
+		}
+		inputValue += prevTX.Vout[vin.Vout].Value
+	}
+
+	outputValue := 0
+	for _,out := range tx.Vout {
+		outputValue += out.Value
+	}
+	if outputValue > inputValue {
+		return 0,errors.New("Transaction outputs are more than its inputs")
+	}
+
+	return inputValue - outputValue,nil
+}
+
+//验证区块中的coinbase交易：它必须是区块的第一笔交易且只有一笔
+//领取的金额不能超过 高度为height的区块的挖矿奖励 + 区块中所有交易的手续费
+func (bc *Blockchain) VerifyCoinbase(transactions []*Transaction, height int) error {
+	if len(transactions) == 0 || !transactions[0].IsCoinbase() {
+		return errors.New("The first transaction of a block must be coinbase")
+	}
+
+	fees := 0
+	for _,tx := range transactions[1:] {
+		if tx.IsCoinbase() {
+			return errors.New("A block can only have one coinbase transaction")
+		}
+		fee,err := bc.TransactionFee(tx)
+		if err != nil {
+			return err
+		}
+		fees += fee
+	}
+
+	reward := 0
+	for _,out := range transactions[0].Vout {
+		reward += out.Value
+	}
+	if reward > BlockSubsidy(height)+fees {
+		return fmt.Errorf("Coinbase pays %d, but subsidy plus fees is only %d",reward,BlockSubsidy(height)+fees)
+	}
+
+	return nil
+}
+
+//交给轻节点的一笔交易，带着它所在区块的哈希和Merkle包含证明
+type ProvenTransaction struct {
+	Transaction []byte
+	BlockHash   []byte
+	Proof       MerkleProof
+}
+
+//在blockHashes这些区块中找出和这些公钥哈希有关的交易：有输出付给它们，或者花费了这样的输出
+//blockHashes是GetBlockHashes返回的主链区块哈希（从顶端到创世块），按上链的顺序返回，每笔都带着Merkle包含证明
+//只读取数据库里的区块，不读bc.tip，节点里可以不拿serverLock调用，区块不会从数据库中删除
+func (bc *Blockchain) FindAddressTransactions(blockHashes [][]byte, pubKeyHashes [][]byte) []ProvenTransaction {
+	var result []ProvenTransaction
+
+	watched := make(map[string]bool)
+	for _, pubKeyHash := range pubKeyHashes {
+		watched[hex.EncodeToString(pubKeyHash)] = true
+	}
+	//付给这些地址的输出（交易ID:输出索引），花费它们的交易也要交给轻节点
+	outputs := make(map[string]bool)
+
+	for i := len(blockHashes) - 1; i >= 0; i-- {
+		block, err := bc.GetBlock(blockHashes[i])
+		if err != nil {
+			log.Panic(err)
+		}
+
+		for _, tx := range block.Transactions {
+			related := false
+			if !tx.IsCoinbase() {
+				for _, vin := range tx.Vin {
+					if outputs[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)] {
+						related = true
+					}
+				}
+			}
+			for outIdx, out := range tx.Vout {
+				if watched[hex.EncodeToString(out.PubKeyHash())] {
+					outputs[fmt.Sprintf("%x:%d", tx.ID, outIdx)] = true
+					related = true
+				}
+			}
+			if !related {
+				continue
+			}
+
+			proof, err := block.MerkleProof(tx.ID)
+			if err != nil {
+				log.Panic(err)
+			}
+			result = append(result, ProvenTransaction{tx.Serialize(), block.Hash, *proof})
+		}
+	}
+
+	return result
+}
+
+//遍历整条链，找到所有在交易输出中出现过的公钥哈希，恢复HD钱包时用来判断哪些地址被用过
+func (bc *Blockchain) FindUsedPubKeyHashes() map[string]bool {
+	used := make(map[string]bool)
+	if len(bc.tip) == 0 {
+		return used
+	}
 	bci := bc.Iterator()
-  
+
 	for {
 		block := bci.Next()
-  
+
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Vout {
+				used[hex.EncodeToString(out.PubKeyHash())] = true
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	return used
+}
+
+//遍历整条链，找到所有的未花费交易输出，按交易ID分组返回
+//未花费交易输出（unspent transactions outputs, UTXO）
+//这个方法很慢，只在重建UTXO集合（UTXOSet.Reindex）的时候调用，平时查询都走UTXO集合
+func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
+	var UTXO map[string]TXOutputs
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		UTXO = findUTXO(tx.Bucket([]byte(blocksBucket)), bc.tip)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return UTXO
+}
+
+//在区块桶blocks中从hash往回遍历到创世块，找出hash这个区块连接完以后的所有未花费交易输出
+//hash为空时是还没有同步到任何区块的空链
+func findUTXO(blocks *bolt.Bucket, hash []byte) map[string]TXOutputs {
+	UTXO := make(map[string]TXOutputs)
+	spentTXOs := make(map[string][]int)
+	if len(hash) == 0 {
+		return UTXO
+	}
+
+	for {
+		block := DeserializeBlock(blocks.Get(hash))
+		hash = block.PrevBlockHash
+
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
-  
+
 		Outputs:
 			for outIdx, out := range tx.Vout {
-		  	// Was the output spent?
-				//如果一个输出被一个地址锁定，并且这个地址恰好是我们要找的未花费交易输出的地址，那么这个输出就是我们想要的
-				//不过在获取它之前，我们需要检查该输出是否已经被包含在一个输入中，也就是检查它是否已经被花费了  
+				//我们是从顶端往回迭代的，所以花费某个输出的输入一定已经先被记录在spentTXOs里了
 				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-						continue Outputs
-			 			}
+					for _, spentOutIdx := range spentTXOs[txID] {
+						if spentOutIdx == outIdx {
+							continue Outputs
+						}
 					}
-		  		}
-				//由于交易被存储在区块里，所以我们不得不检查区块链里的每一笔交易
-				//从输出开始
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTXs = append(unspentTXs, *tx)
-		  		}
+				}
+
+				outs, ok := UTXO[txID]
+				if !ok {
+					outs = TXOutputs{make(map[int]TXOutput), block.Height, tx.IsCoinbase()}
+				}
+				outs.Outputs[outIdx] = out
+				UTXO[txID] = outs
 			}
-		//检查完输出以后，我们将所有能够解锁给定地址锁定的输出的输入聚集起来
-		//这并不适用于 coinbase 交易，因为它们不解锁输出
-		if tx.IsCoinbase() == false {
-		  for _, in := range tx.Vin {
-			if in.UsesKey(pubKeyHash) {
-			  inTxID := hex.EncodeToString(in.Txid)
-			  spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
+
+			//coinbase 交易不解锁输出，所以不用记录它的输入
+			if tx.IsCoinbase() == false {
+				for _, in := range tx.Vin {
+					inTxID := hex.EncodeToString(in.Txid)
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
+				}
 			}
-		  }
 		}
-	  }
-  
-	  if len(block.PrevBlockHash) == 0 {
-		break
-	  }
-	}
-	//这个函数返回了一个交易列表，里面包含了未花费输出
-	return unspentTXs
-}
-
-//为了计算余额，我们还需要一个函数将这些交易作为输入，然后仅返回一个输出切片
-func (bc *Blockchain) FindUTXO(pubKeyHash []byte) []TXOutput {
-	var UTXOs []TXOutput
-	unspentTransactions := bc.FindUnspentTransactions(pubKeyHash)
 
-	for _, tx := range unspentTransactions {
-			for _, out := range tx.Vout {
-					if out.IsLockedWithKey(pubKeyHash) {
-							UTXOs = append(UTXOs, out)
-					}
-			}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
 	}
 
-	return UTXOs
+	return UTXO
 }
 
 //现在，我们想要给其他人发送一些币。为此，我们需要创建一笔新的交易，将它放到一个块里，然后挖出这个块
 //之前我们只实现了 coinbase 交易，现在我们需要一种通用的交易
-func NewUTXOTransaction(from, to string, amount int, bc *Blockchain) *Transaction {
+//已经被交易池中的交易花费的输出不会再被选中，否则新交易会和交易池里的交易冲突
+//fee是付给矿工的手续费，不在输出中出现：输入总额 = amount + 找零 + fee
+//lockTime是交易的锁定时间；lockOp不为0时，付给to的输出加上时间锁，lockOp和lock的含义见TXOutput.LockUntil
+func NewUTXOTransaction(from, to string, amount, fee int, lockTime int64, lockOp byte, lock int64, UTXOSet *UTXOSet, mempool *Mempool) *Transaction {
     var inputs []TXInput
     var outputs []TXOutput
 
+	//负数的金额或手续费会让输出变成负数，这样的交易不会被接受
+	if amount <= 0 || fee < 0 {
+		log.Panic("ERROR: Amount must be positive and fee can not be negative")
+	}
+
     wallets,err := NewWallets()
 	if err != nil {
 		log.Panic(err)
 	}
+	//加密的钱包要先解锁才能签名，命令行见unlockWallets，节点见RPC的walletpassphrase
+	if wallets.IsLocked() {
+		log.Panic(ErrWalletLocked)
+	}
 	_wallet := wallets.GetWallet(from)
 	pubKeyHash := HashPubKey(_wallet.PublicKey)
-	acc, validOutputs := bc.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+fee, mempool)
 
 	//fmt.Println(acc)
 
-    if acc < amount {
+    if acc < amount+fee {
         log.Panic("ERROR: Not enough funds")
     }
 
@@ -309,55 +753,28 @@ func NewUTXOTransaction(from, to string, amount int, bc *Blockchain) *Transactio
 			log.Panic(err)
 		}
         for _, out := range outs {
-            input := TXInput{txID,out,nil,_wallet.PublicKey}
+            input := TXInput{txID,out,nil}
             inputs = append(inputs, input)
         }
     }
 
     // Build a list of outputs
-    outputs = append(outputs, *NewTXOutput(amount,to))
-    if acc > amount {
-        outputs = append(outputs, *NewTXOutput(acc - amount,from))
+    output := NewTXOutput(amount,to)
+    if lockOp != 0 {
+        output.LockUntil(lockOp,lock)
+    }
+    outputs = append(outputs, *output)
+    if acc > amount+fee {
+        outputs = append(outputs, *NewTXOutput(acc - amount - fee,from))
     }
 
-    tx := Transaction{nil, inputs, outputs}
+    tx := Transaction{txVersion, nil, inputs, outputs, lockTime}
     tx.ID = tx.Hash()
 
 	//fmt.Println(tx.ID)
 	//fmt.Println(_wallet.PrivateKey)
 	
-	bc.SignTransaction(&tx, _wallet.PrivateKey)
+	UTXOSet.Blockchain.SignTransaction(&tx, _wallet.PrivateKey)
 
     return &tx
 }
-
-//在创建新的输出前，我们首先必须找到所有的未花费输出，并且确保它们存储了足够的值
-//我们创建两个输出：
-//1.	一个由接收者地址锁定。这是给实际给其他地址转移的币。
-//2.	一个由发送者地址锁定。这是一个找零。只有当未花费输出超过新交易所需时产生。记住：输出是不可再分的
-//FindSpendableOutputs 方法基于之前定义的 FindUnspentTransactions 方法
-func (bc *Blockchain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-    unspentOutputs := make(map[string][]int)
-    unspentTXs := bc.FindUnspentTransactions(pubKeyHash)
-    accumulated := 0
-
-Work:
-    for _, tx := range unspentTXs {
-        txID := hex.EncodeToString(tx.ID)
-
-        for outIdx, out := range tx.Vout {
-            if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-                accumulated += out.Value
-                unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				//对所有的未花费交易进行迭代，并对它的值进行累加
-				//累加值大于或等于我们想要传送的值时，它就会停止并返回累加值，同时返回的还有通过交易 ID 进行分组的输出索引
-				//我们并不想要取出超出需要花费的钱
-                if accumulated >= amount {
-                    break Work
-                }
-            }
-        }
-    }
-
-    return accumulated, unspentOutputs
-}
\ No newline at end of file
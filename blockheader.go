@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"math/big"
+	"strconv"
+	"github.com/boltdb/bolt"
+)
+
+//区块头的桶，键是区块哈希，值是区块头的编码
+//沿着链往回走和验证工作量证明都只需要区块头，不用再解码区块里的交易
+const headersBucket = "headers"
+
+//区块头，区块的哈希就是区块头的哈希
+//Height不是比特币区块头里的字段，但版本1以后的区块头编码一直带着它，为了区块哈希不变保留下来
+type BlockHeader struct {
+	Version       int
+	PrevBlockHash []byte
+	MerkleRoot    []byte//区块中交易的Merkle根，交易有任何改动区块哈希都会变
+	Timestamp     int64
+	Bits          int
+	Nonce         int
+	Height        int
+}
+
+//区块的区块头，Merkle根由交易算出来
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{b.Version, b.PrevBlockHash, b.HashTransactions(), b.Timestamp, b.Bits, b.Nonce, b.Height}
+}
+
+//区块头的编码，格式见encoding.go
+func (h *BlockHeader) Serialize() []byte {
+	e := &encoder{}
+	e.blockHeader(h, h.Nonce)
+	return e.buf.Bytes()
+}
+
+//解码区块头
+func DeserializeHeader(d []byte) *BlockHeader {
+	header, err := decodeHeader(d)
+	if err != nil {
+		log.Panic(err)
+	}
+	return header
+}
+
+//解码区块头，数据不完整或有多余的数据时返回错误
+func decodeHeader(data []byte) (*BlockHeader, error) {
+	var header BlockHeader
+
+	d := &decoder{data: data}
+	d.blockHeader(&header)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+//工作量证明要做哈希的数据，nonce单独传入，挖矿时每次尝试只换nonce
+//版本1以上就是区块头的编码，版本0的旧区块仍然按原来的方式把各字段的字符串拼起来
+func (h *BlockHeader) powData(nonce int) []byte {
+	if h.Version != 0 {
+		e := &encoder{}
+		e.blockHeader(h, nonce)
+		return e.buf.Bytes()
+	}
+
+	return bytes.Join(
+		[][]byte{
+			h.PrevBlockHash,
+			h.MerkleRoot,
+			[]byte(strconv.FormatInt(h.Timestamp, 10)),
+			[]byte(strconv.FormatInt(int64(h.Bits), 10)),
+			[]byte(strconv.FormatInt(int64(nonce), 10)),
+		},
+		[]byte{},
+	)
+}
+
+//区块头的哈希，也就是区块的哈希
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.powData(h.Nonce))
+	return hash[:]
+}
+
+//验证区块头满足工作量证明，expectedBits是按照链的难度调整规则这个区块应该有的难度
+func (h *BlockHeader) Validate(expectedBits int) bool {
+	if h.Bits != expectedBits {
+		return false
+	}
+
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-h.Bits))
+	hashInt := new(big.Int).SetBytes(h.Hash())
+
+	return hashInt.Cmp(target) == -1
+}
+
+//保存区块头，tx必须是可写的事务
+func putHeader(tx *bolt.Tx, hash []byte, header *BlockHeader) {
+	headers, err := tx.CreateBucketIfNotExists([]byte(headersBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+	err = headers.Put(hash, header.Serialize())
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+//读取区块头，没有这个区块时返回nil
+func getHeader(tx *bolt.Tx, hash []byte) *BlockHeader {
+	data := tx.Bucket([]byte(headersBucket)).Get(hash)
+	if data == nil {
+		return nil
+	}
+	return DeserializeHeader(data)
+}
+
+//之前版本的数据库没有区块头的桶，打开时从已经保存的区块建立起来，之后每保存一个区块都同时保存它的区块头
+//tx必须是可写的事务
+func indexHeaders(tx *bolt.Tx) {
+	if tx.Bucket([]byte(headersBucket)) != nil {
+		return
+	}
+	headers, err := tx.CreateBucket([]byte(headersBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = tx.Bucket([]byte(blocksBucket)).ForEach(func(k, v []byte) error {
+		if bytes.Equal(k, []byte("l")) || bytes.Equal(k, dbFormatKey) || bytes.Equal(k, utxoFormatKey) {
+			return nil
+		}
+		return headers.Put(k, DeserializeBlock(v).Header().Serialize())
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+//通过区块哈希找到一个区块头
+func (bc *Blockchain) GetHeader(blockHash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		header = getHeader(tx, blockHash)
+		if header == nil {
+			return errors.New("Block is not found")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+//区块头迭代器，和BlockchainIterator一样从某个区块往回走，但只读区块头
+type HeaderIterator struct {
+	currentHash []byte
+	db          *bolt.DB
+}
+
+//从顶端区块开始的区块头迭代器
+func (bc *Blockchain) HeaderIterator() *HeaderIterator {
+	return &HeaderIterator{bc.tip, bc.db}
+}
+
+//返回当前区块的哈希和区块头，然后移到上一个区块
+//哈希是数据库中保存的键，版本0的旧区块有一些按规则算不出原来的哈希（见legacyBlockReproducible），所以不用Hash()
+func (i *HeaderIterator) Next() ([]byte, *BlockHeader) {
+	var header *BlockHeader
+
+	err := i.db.View(func(tx *bolt.Tx) error {
+		header = getHeader(tx, i.currentHash)
+		if header == nil {
+			log.Panicf("ERROR: Block %x is not found", i.currentHash)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	hash := i.currentHash
+	i.currentHash = header.PrevBlockHash
+
+	return hash, header
+}
+
+//区块定位器：从高度为tipHeight的顶端往回的一组主链区块哈希，前10个是连续的，之后间隔每次翻倍，最后是创世块
+//对方用它找到双方主链最后一个共同的区块，轻节点的数据库也有同样的高度索引
+func blockLocator(db *bolt.DB, tipHeight int) [][]byte {
+	var locator [][]byte
+
+	err := db.View(func(tx *bolt.Tx) error {
+		heights := tx.Bucket([]byte(heightBucket))
+		step := 1
+		for height := tipHeight; height > 0; height -= step {
+			locator = append(locator, append([]byte{}, heights.Get(heightKey(height))...))
+			if len(locator) >= 10 {
+				step *= 2
+			}
+		}
+		if tipHeight >= 0 {
+			locator = append(locator, append([]byte{}, heights.Get(heightKey(0))...))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return locator
+}
+
+//locator中第一个在主链上的区块之后的主链区块头，按高度从低到高，最多limit个
+//locator中没有主链上的区块时从创世块开始，返回区块头的编码
+func (bc *Blockchain) HeadersAfter(locator [][]byte, limit int) [][]byte {
+	var result [][]byte
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		heights := tx.Bucket([]byte(heightBucket))
+		if heights == nil {
+			return nil
+		}
+
+		start := 0
+		for _, hash := range locator {
+			header := getHeader(tx, hash)
+			if header != nil && bytes.Equal(heights.Get(heightKey(header.Height)), hash) {
+				start = header.Height + 1
+				break
+			}
+		}
+
+		headerData := tx.Bucket([]byte(headersBucket))
+		c := heights.Cursor()
+		for k, v := c.Seek(heightKey(start)); k != nil && len(result) < limit; k, v = c.Next() {
+			result = append(result, append([]byte{}, headerData.Get(v)...))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"github.com/boltdb/bolt"
+)
+
+//区块索引的桶，存放每个区块（包括不在主链上的分支区块）的高度和累计工作量
+const blockIndexBucket = "blockindex"
+
+//主链高度索引的桶，键是8字节大端序的高度，值是主链上这个高度的区块哈希
+const heightBucket = "heights"
+
+//区块撤销数据的桶，存放每个区块花费掉的输出，分叉切换时用来回滚UTXO集合
+const undoBucket = "undo"
+
+//分叉切换的审计日志文件
+const reorgLogFile = "reorg.log"
+
+//回滚一个区块时找不到它的撤销数据（这个区块是在有撤销数据之前连接的），只能重建UTXO集合
+var errMissingUndo = errors.New("Undo data of block is not found")
+
+//区块索引中的一条记录
+//ChainWork是从创世块到这个区块为止所有区块工作量的总和，顶端区块总是累计工作量最大的那条分支的最后一个区块
+//Invalid表示区块在连接时没有通过验证，它和它后面的区块都不会再被接收
+type blockIndexEntry struct {
+	Height    int
+	ChainWork []byte
+	Invalid   bool
+}
+
+//区块花费掉的一个输出，Height和Coinbase同TXOutputs
+type spentOutput struct {
+	Txid     []byte
+	Vout     int
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+//和数据库文件一样，每个节点的审计日志文件用NODE_ID区分
+func reorgLogFileName() string {
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		return dataFile(reorgLogFile)
+	}
+	return dataFile(fmt.Sprintf("reorg_%s.log", nodeID))
+}
+
+//一个区块的工作量，target = 2^(256-bits)，找到一个有效哈希平均要尝试2^bits次
+func blockWork(bits int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits))
+}
+
+//读取区块索引中的一条记录，如果还没有（比如之前版本保存的区块），就从最近一个有记录的祖先区块开始算出来并保存
+//tx必须是可写的事务
+func getBlockIndex(tx *bolt.Tx, hash []byte) blockIndexEntry {
+	index, err := tx.CreateBucketIfNotExists([]byte(blockIndexBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	//往回找到第一个已经有索引记录的祖先，只需要读区块头
+	var missing []*BlockHeader
+	var missingHashes [][]byte
+	var entry blockIndexEntry
+	current := hash
+	for {
+		if data := index.Get(current); data != nil {
+			entry = deserializeBlockIndexEntry(data)
+			break
+		}
+
+		header := getHeader(tx, current)
+		if header == nil {
+			log.Panicf("ERROR: Block %x is not found", current)
+		}
+		missing = append(missing, header)
+		missingHashes = append(missingHashes, current)
+
+		if len(header.PrevBlockHash) == 0 {
+			entry = blockIndexEntry{-1, big.NewInt(0).Bytes(), false}
+			break
+		}
+		current = header.PrevBlockHash
+	}
+
+	//再从祖先往前把缺少的记录补上
+	for i := len(missing) - 1; i >= 0; i-- {
+		header := missing[i]
+		work := new(big.Int).SetBytes(entry.ChainWork)
+		work.Add(work, blockWork(header.Bits))
+		entry = blockIndexEntry{header.Height, work.Bytes(), false}
+
+		err := index.Put(missingHashes[i], entry.serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return entry
+}
+
+//高度索引的键，大端序保证桶中的键按高度排序
+func heightKey(height int) []byte {
+	return IntToHex(int64(height))
+}
+
+//由高度索引的键得到高度
+func heightFromKey(key []byte) int {
+	return int(binary.BigEndian.Uint64(key))
+}
+
+//让高度索引和以tip为顶端的主链一致：去掉比tip高的记录，再从tip往回改写，直到某个高度的记录已经是主链上的区块
+//分叉切换时只需要改写分叉点之后的记录；之前版本的数据库没有这个桶，第一次会从创世块建立起来
+//tx必须是可写的事务
+func updateHeightIndex(tx *bolt.Tx, tip []byte) {
+	heights, err := tx.CreateBucketIfNotExists([]byte(heightBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+	hash := tip
+	header := getHeader(tx, hash)
+
+	var stale [][]byte
+	c := heights.Cursor()
+	for k, _ := c.Last(); k != nil && bytes.Compare(k, heightKey(header.Height)) > 0; k, _ = c.Prev() {
+		stale = append(stale, k)
+	}
+	for _, k := range stale {
+		err := heights.Delete(k)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	for {
+		key := heightKey(header.Height)
+		if bytes.Equal(heights.Get(key), hash) {
+			break
+		}
+		err := heights.Put(key, hash)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if len(header.PrevBlockHash) == 0 {
+			break
+		}
+		hash = header.PrevBlockHash
+		header = getHeader(tx, hash)
+	}
+}
+
+//保存一个区块，还不会改变顶端区块
+//已经保存过的区块、父区块未知的区块以及和我们的创世块不同的另一个创世块都不保存，返回false
+func (bc *Blockchain) storeBlock(block *Block) bool {
+	stored := false
+
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		//已经有这个区块了
+		if b.Get(block.Hash) != nil {
+			return nil
+		}
+		if len(block.PrevBlockHash) == 0 {
+			//已经有了创世块，另一个创世块开始的链和我们的链没有关系
+			if b.Get([]byte("l")) != nil {
+				fmt.Printf("Block %x is a different genesis block, skipped\n", block.Hash)
+				return nil
+			}
+		} else if b.Get(block.PrevBlockHash) == nil {
+			//父区块还不存在的区块先不接收，等同步到它的父区块以后再说
+			fmt.Printf("Block %x has an unknown parent, skipped\n", block.Hash)
+			return nil
+		}
+
+		err := b.Put(block.Hash, block.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+		putHeader(tx, block.Hash, block.Header())
+		getBlockIndex(tx, block.Hash)
+		stored = true
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return stored
+}
+
+//如果block所在分支的累计工作量比当前主链大，就把它设置为新的顶端区块
+//新区块直接接在顶端后面时只需要把它连接到UTXO集合，否则要先回滚旧分支的区块，再依次连接新分支的区块
+//累计工作量相同时保留先收到的分支
+//新分支上的某个区块没有通过验证时，整个切换都会回滚，这个区块被标记为无效，返回验证错误
+//之后再从剩下的有效区块中选一次累计工作量最大的分支，无效区块之前的那一段可能已经比旧的顶端工作量大了
+func (bc *Blockchain) activateBestChain(block *Block) error {
+	var disconnected, connected []*Block
+	var fork *Block
+	var oldTip *Block
+	var badBlock *Block
+
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+		newEntry := getBlockIndex(tx, block.Hash)
+
+		if bc.tip != nil {
+			tipEntry := getBlockIndex(tx, bc.tip)
+			newWork := new(big.Int).SetBytes(newEntry.ChainWork)
+			tipWork := new(big.Int).SetBytes(tipEntry.ChainWork)
+			if newWork.Cmp(tipWork) <= 0 {
+				return nil
+			}
+			oldTip = DeserializeBlock(blocks.Get(bc.tip))
+		}
+
+		//找到新旧两条分支的分叉点：先把高的一边退到和另一边一样高，再一起往回退，直到是同一个区块
+		oldBranch := oldTip
+		newBranch := block
+		for oldBranch != nil && oldBranch.Height > newBranch.Height {
+			disconnected = append(disconnected, oldBranch)
+			oldBranch = DeserializeBlock(blocks.Get(oldBranch.PrevBlockHash))
+		}
+		for oldBranch == nil || newBranch.Height > oldBranch.Height {
+			connected = append([]*Block{newBranch}, connected...)
+			if len(newBranch.PrevBlockHash) == 0 {
+				break
+			}
+			newBranch = DeserializeBlock(blocks.Get(newBranch.PrevBlockHash))
+		}
+		for oldBranch != nil && bytes.Compare(oldBranch.Hash, newBranch.Hash) != 0 {
+			disconnected = append(disconnected, oldBranch)
+			connected = append([]*Block{newBranch}, connected...)
+			oldBranch = DeserializeBlock(blocks.Get(oldBranch.PrevBlockHash))
+			newBranch = DeserializeBlock(blocks.Get(newBranch.PrevBlockHash))
+		}
+		fork = oldBranch
+
+		UTXOSet := UTXOSet{bc}
+		for i, b := range disconnected {
+			err := UTXOSet.disconnectBlock(tx, b)
+			if err == errMissingUndo {
+				//旧分支上有撤销数据出现之前连接的区块，没法一个个回滚，直接从区块重建分叉点的UTXO集合
+				//新分支的区块还是在下面逐个连接和验证，验证失败时整个事务回滚，UTXO集合不变
+				UTXOSet.rebuild(tx, fork.Hash)
+				undo := tx.Bucket([]byte(undoBucket))
+				for _, b := range disconnected[i:] {
+					if undo != nil {
+						if err := undo.Delete(b.Hash); err != nil {
+							log.Panic(err)
+						}
+					}
+					unindexBlockTransactions(tx, b)
+				}
+				break
+			}
+			if err != nil {
+				return err
+			}
+			unindexBlockTransactions(tx, b)
+		}
+		for _, b := range connected {
+			err := UTXOSet.connectBlock(tx, b)
+			if err != nil {
+				badBlock = b
+				return err
+			}
+			indexBlockTransactions(tx, b)
+		}
+
+		err := blocks.Put([]byte("l"), block.Hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		updateHeightIndex(tx, block.Hash)
+
+		return nil
+	})
+	if badBlock != nil {
+		//无效区块后面的区块也都是无效的，这条分支上从它到block的区块都标记为无效，以后不会再尝试连接
+		bad := false
+		for _, b := range connected {
+			bad = bad || b == badBlock
+			if bad {
+				bc.markInvalid(b.Hash)
+			}
+		}
+		if best := bc.bestValidBlock(); best != nil {
+			bc.activateBestChain(best)
+		}
+		return err
+	} else if err != nil {
+		log.Panic(err)
+	}
+	if len(connected) == 0 {
+		return nil
+	}
+	bc.setTip(block.Hash)
+
+	if len(disconnected) > 0 {
+		logReorg(oldTip, block, fork, disconnected, connected)
+	}
+
+	return nil
+}
+
+//把区块标记为无效
+func (bc *Blockchain) markInvalid(hash []byte) {
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		entry := getBlockIndex(tx, hash)
+		entry.Invalid = true
+		return tx.Bucket([]byte(blockIndexBucket)).Put(hash, entry.serialize())
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+//在区块索引中找出累计工作量比当前顶端大、它和它的祖先都没有被标记为无效的区块，累计工作量最大的那个
+//没有这样的区块时返回nil
+func (bc *Blockchain) bestValidBlock() *Block {
+	var best *Block
+	if bc.tip == nil {
+		return nil
+	}
+
+	//旧版本的数据库里顶端区块可能还没有索引记录，getBlockIndex要用可写的事务
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		bestWork := new(big.Int).SetBytes(getBlockIndex(tx, bc.tip).ChainWork)
+		index := tx.Bucket([]byte(blockIndexBucket))
+		blocks := tx.Bucket([]byte(blocksBucket))
+		heights := tx.Bucket([]byte(heightBucket))
+
+		return index.ForEach(func(k, v []byte) error {
+			entry := deserializeBlockIndexEntry(v)
+			work := new(big.Int).SetBytes(entry.ChainWork)
+			if entry.Invalid || work.Cmp(bestWork) <= 0 || blocks.Get(k) == nil {
+				return nil
+			}
+			//往回检查到主链为止，主链上的区块都是连接过的有效区块
+			hash := k
+			for {
+				ancestor := index.Get(hash)
+				if ancestor != nil && deserializeBlockIndexEntry(ancestor).Invalid {
+					return nil
+				}
+				header := getHeader(tx, hash)
+				if bytes.Equal(heights.Get(heightKey(header.Height)), hash) || len(header.PrevBlockHash) == 0 {
+					break
+				}
+				hash = header.PrevBlockHash
+			}
+
+			best = DeserializeBlock(blocks.Get(k))
+			bestWork = work
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return best
+}
+
+//把分叉切换写进审计日志，同时打印出来
+func logReorg(oldTip, newTip, fork *Block, disconnected, connected []*Block) {
+	f, err := os.OpenFile(reorgLogFileName(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	logger := log.New(f, "", log.LstdFlags)
+	message := fmt.Sprintf("REORG old tip %x (height %d) -> new tip %x (height %d), fork at %x (height %d), %d blocks disconnected, %d blocks connected",
+		oldTip.Hash, oldTip.Height, newTip.Hash, newTip.Height, fork.Hash, fork.Height, len(disconnected), len(connected))
+	logger.Println(message)
+	for _, b := range disconnected {
+		logger.Printf("  disconnected %x (height %d)\n", b.Hash, b.Height)
+	}
+	for _, b := range connected {
+		logger.Printf("  connected    %x (height %d)\n", b.Hash, b.Height)
+	}
+
+	fmt.Println(message)
+}
+
+//序列化区块索引中的一条记录
+func (entry blockIndexEntry) serialize() []byte {
+	var result bytes.Buffer
+
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(entry)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+//反序列化区块索引中的一条记录
+func deserializeBlockIndexEntry(data []byte) blockIndexEntry {
+	var entry blockIndexEntry
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&entry)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return entry
+}
+
+//序列化一个区块的撤销数据
+func serializeUndo(spent []spentOutput) []byte {
+	var result bytes.Buffer
+
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(spent)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+//反序列化一个区块的撤销数据，版本3之前保存的输出换成脚本，见storedOutput
+func deserializeUndo(data []byte) []spentOutput {
+	var stored []struct {
+		Txid     []byte
+		Vout     int
+		Output   storedOutput
+		Height   int
+		Coinbase bool
+	}
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&stored)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var spent []spentOutput
+	for _, s := range stored {
+		spent = append(spent, spentOutput{s.Txid, s.Vout, s.Output.output(), s.Height, s.Coinbase})
+	}
+	return spent
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/*网络参数，一个网络的创世块、地址版本、难度规则、奖励规则、默认端口和文件名都在这里
+启动时用-network NAME选择网络（-regtest是-network regtest的简写），不选时是主网络
+不同网络的地址版本不同，一个网络的地址在另一个网络上通不过ValidateAddress
+每个网络的创世块是固定的，它的哈希写在GenesisHash里，节点握手时和轻节点同步区块头时都用它确认对方在同一个网络上
+*/
+type ChainParams struct {
+	Name    string
+	DataDir string //数据文件所在的目录，为空时就在工作目录下
+
+	//创世块，由下面这几项构造出来（见GenesisBlock），哈希必须等于GenesisHash
+	GenesisCoinbaseData string //创世块coinbase交易中的信息，每个网络都不一样
+	GenesisBits         int    //创世块的难度
+	GenesisTime         int64  //创世块的时间戳
+	GenesisNonce        int    //满足创世块难度的nonce
+	GenesisHash         string //创世块的哈希，十六进制
+
+	//地址的版本
+	PubKeyHashAddrID byte //普通地址
+	ScriptHashAddrID byte //多重签名地址，和比特币的P2SH地址一样
+
+	//难度调整
+	RetargetInterval int   //每隔多少个区块调整一次难度
+	TargetSpacing    int64 //期望的出块间隔（秒）
+	NoRetargeting    bool  //难度不调整，一直是创世块的难度
+
+	//挖矿奖励
+	Subsidy          int //创世块的挖矿奖励，之后每HalvingInterval个区块减半
+	HalvingInterval  int //每挖出多少个区块奖励减半
+	MaxSupply        int //币的总量上限，发行量达到上限以后矿工只能领取手续费
+	CoinbaseMaturity int //coinbase交易的输出要等到所在区块后面又挖出这么多个区块以后才能花费
+
+	DefaultPort string //startnode没有给-port时监听的端口
+
+	//文件名，设置了NODE_ID时会在名字里加上节点号
+	DBFile     string
+	WalletFile string
+}
+
+/*主网络
+难度没有设置太高，主要是考虑调试时的时间成本
+奖励减半的间隔、总量上限和coinbase成熟的区块数都按比例缩小了，比特币分别是210000、2100万和100
+*/
+var MainNetParams = ChainParams{
+	Name:                "main",
+	DataDir:             "",
+	GenesisCoinbaseData: "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks",
+	GenesisBits:         15,
+	GenesisTime:         1704067200,
+	GenesisNonce:        55958,
+	GenesisHash:         "0001c81d2691c6ebea296f769aa0e8bac5ac0be31c5b2e3707ec6fb10ecbc0f1",
+	PubKeyHashAddrID:    0x00,
+	ScriptHashAddrID:    0x05,
+	RetargetInterval:    10,
+	TargetSpacing:       10,
+	NoRetargeting:       false,
+	Subsidy:             50,
+	HalvingInterval:     210,
+	MaxSupply:           20000,
+	CoinbaseMaturity:    10,
+	DefaultPort:         "3000",
+	DBFile:              "blockchain.db",
+	WalletFile:          "wallet.dat",
+}
+
+/*测试网络，规则和主网络一样，币没有价值，给大家一起试验用
+1.	初始难度比主网络低一些
+2.	区块链数据库、钱包等文件都放在testnet目录下
+3.	地址用自己的版本号，普通地址以T开头，多重签名地址以t开头
+*/
+var TestNetParams = ChainParams{
+	Name:                "testnet",
+	DataDir:             "testnet",
+	GenesisCoinbaseData: "Testnet genesis: the coins on this network have no value",
+	GenesisBits:         12,
+	GenesisTime:         1704067200,
+	GenesisNonce:        1683,
+	GenesisHash:         "000f8e0d3d1979faf25f32d2c5348407dd5f028ff168cfefe8a59445c66dac2e",
+	PubKeyHashAddrID:    0x41,
+	ScriptHashAddrID:    0x80,
+	RetargetInterval:    10,
+	TargetSpacing:       10,
+	NoRetargeting:       false,
+	Subsidy:             50,
+	HalvingInterval:     210,
+	MaxSupply:           20000,
+	CoinbaseMaturity:    10,
+	DefaultPort:         "23000",
+	DBFile:              "blockchain.db",
+	WalletFile:          "wallet.dat",
+}
+
+/*回归测试（regtest）网络，给集成测试用
+1.	难度是最低的minTargetBits，并且不调整，挖一个区块几乎不需要时间
+2.	区块链数据库、钱包等文件都放在regtest目录下，不会碰到工作目录里正常的blockchain.db
+3.	地址用自己的版本号，和比特币的测试网络一样，普通地址以m或n开头，多重签名地址以2开头
+*/
+var RegTestParams = ChainParams{
+	Name:                "regtest",
+	DataDir:             "regtest",
+	GenesisCoinbaseData: "Regtest genesis: blocks are mined at once for integration tests",
+	GenesisBits:         minTargetBits,
+	GenesisTime:         1704067200,
+	GenesisNonce:        0,
+	GenesisHash:         "402a6a54772032ca860e385e5aa3b810540eea55f60a5df17ba750391fcd7b01",
+	PubKeyHashAddrID:    0x6f,
+	ScriptHashAddrID:    0xc4,
+	RetargetInterval:    10,
+	TargetSpacing:       10,
+	NoRetargeting:       true,
+	Subsidy:             50,
+	HalvingInterval:     210,
+	MaxSupply:           20000,
+	CoinbaseMaturity:    10,
+	DefaultPort:         "13000",
+	DBFile:              "blockchain.db",
+	WalletFile:          "wallet.dat",
+}
+
+//可以选择的网络
+var networks = []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams}
+
+//当前运行的网络
+var params = &MainNetParams
+
+//切换到名为name的网络，要在打开任何文件之前调用
+func selectNetwork(name string) {
+	for _, p := range networks {
+		if p.Name != name {
+			continue
+		}
+		params = p
+		if p.DataDir != "" {
+			err := os.MkdirAll(p.DataDir, 0700)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		return
+	}
+	log.Panicf("ERROR: Unknown network %s", name)
+}
+
+//数据文件的路径，放在当前网络的DataDir目录下
+func dataFile(name string) string {
+	return filepath.Join(params.DataDir, name)
+}
+
+//创世块固定用这两个编码版本，以后升级了区块和交易的版本，创世块的哈希也不会变
+const (
+	genesisBlockVersion = 2
+	genesisTxVersion    = 4
+)
+
+//构造这个网络的创世块
+//创世块的coinbase输出是OP_RETURN，谁也花不了；createblockchain会接着挖出高度1的区块，奖励给指定的地址
+func (p *ChainParams) GenesisBlock() *Block {
+	txin := TXInput{[]byte{}, -1, opPush([]byte(p.GenesisCoinbaseData))}
+	txout := TXOutput{p.Subsidy, NullDataScript([]byte(p.Name))}
+	coinbase := &Transaction{genesisTxVersion, nil, []TXInput{txin}, []TXOutput{txout}, 0}
+	coinbase.ID = coinbase.Hash()
+
+	block := &Block{genesisBlockVersion, p.GenesisTime, []*Transaction{coinbase}, []byte{}, nil, p.GenesisNonce, 0, p.GenesisBits}
+	block.Hash = block.Header().Hash()
+	if !bytes.Equal(block.Hash, p.GenesisHashBytes()) {
+		log.Panicf("ERROR: Genesis block of network %s is %x, not %s", p.Name, block.Hash, p.GenesisHash)
+	}
+
+	return block
+}
+
+//创世块的哈希
+func (p *ChainParams) GenesisHashBytes() []byte {
+	hash, err := hex.DecodeString(p.GenesisHash)
+	if err != nil {
+		log.Panic(err)
+	}
+	return hash
+}
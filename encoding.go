@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"github.com/boltdb/bolt"
+)
+
+/*区块和交易的二进制编码
+之前区块和交易都用gob编码，gob的输出依赖于Go的实现细节（比如类型编号是按进程中第一次使用的顺序分配的），
+交易ID又是对这个输出做哈希，换一种语言甚至换一个进程都不一定能算出同样的ID。
+现在改成下面这种固定的编码，所有整数都是大端序，变长的数据前面加上长度：
+
+	u32         4字节无符号整数
+	i64         8字节有符号整数
+	bytes       u32长度 + 内容
+	list(X)     u32个数 + 每一项X
+
+	交易      = u32 Version + bytes ID + list(输入) + list(输出) + i64 LockTime
+	输入      = bytes Txid + i64 Vout + bytes ScriptSig
+	输出      = i64 Value + bytes ScriptPubKey
+	区块头    = u32 Version + bytes PrevBlockHash + bytes MerkleRoot + i64 Timestamp + i64 Bits + i64 Nonce + i64 Height
+	区块      = 区块头 + bytes Hash + list(bytes 交易)
+
+区块头单独保存在headersBucket中，见BlockHeader。
+
+版本4之前的交易没有LockTime，它总是0。版本3之前的交易还没有脚本，输入和输出是下面的格式，方括号中的字段从版本2开始才有，Multisig是0或1：
+
+	输入      = bytes Txid + i64 Vout + bytes Signature + bytes PubKey [+ list(bytes Signatures)]
+	输出      = i64 Value + bytes PubkeyHash [+ u32 Multisig]
+
+读出来以后换成同样效果的标准脚本（见legacyUnlockingScript和legacyLockingScript），重新编码时再换回去，所以ID和签名都不变。
+版本3以上的交易，ID是把ID和所有输入的ScriptSig都置空以后整个编码的sha256，因为ID是在签名之前算出来的；
+coinbase交易的ScriptSig是它附带的数据，不置空；版本3之前的交易只去掉签名，保留公钥。见Transaction.ComputeID。
+只把ID置空的编码的sha256是交易的Hash()，不是ID，签过名的交易两者不同。
+版本1以上的区块，工作量证明的数据就是区块头的编码。
+版本2的区块编码和版本1一样，从版本2开始区块中的交易不能花费还不够成熟的coinbase输出，见ChainParams.CoinbaseMaturity。
+版本0是用gob编码时期的区块和交易，为了让它们的ID和哈希保持不变，仍然按原来的方式计算，见legacyData。
+*/
+const (
+	txVersion    = 4 //版本2增加了多重签名，版本3的输入和输出改成了脚本，版本4增加了LockTime
+	blockVersion = 2
+)
+
+//数据库中区块的编码格式，保存在blocksBucket的dbFormatKey下，没有这个键的数据库是用gob编码的旧数据库
+const dbFormat = "1"
+
+var dbFormatKey = []byte("format")
+
+var errTrailingData = errors.New("Unexpected data after the end of the encoding")
+
+//按上面的格式写数据
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+//按上面的格式读数据，出错以后后面的读取都不再进行，最后检查err
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = fmt.Errorf("Encoding is truncated, need %d bytes but only %d left", n, len(d.data))
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+//列表的长度，每一项至少占minSize字节，长度明显不对时直接报错，不会按它分配内存
+func (d *decoder) count(minSize int) int {
+	n := int(d.uint32())
+	if d.err == nil && n*minSize > len(d.data) {
+		d.err = fmt.Errorf("List of %d items does not fit in %d bytes", n, len(d.data))
+		return 0
+	}
+	return n
+}
+
+//读完以后不能有多余的数据，同一个区块或交易只有一种编码
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errTrailingData
+	}
+	return d.err
+}
+
+func (e *encoder) transaction(tx *Transaction) {
+	e.uint32(uint32(tx.Version))
+	e.bytes(tx.ID)
+	e.uint32(uint32(len(tx.Vin)))
+	for _, vin := range tx.Vin {
+		e.bytes(vin.Txid)
+		e.int64(int64(vin.Vout))
+		if tx.Version >= 3 {
+			e.bytes(vin.ScriptSig)
+			continue
+		}
+		signature, pubKey, signatures, err := legacyInputFields(vin.ScriptSig)
+		if err != nil {
+			log.Panic(err)
+		}
+		e.bytes(signature)
+		e.bytes(pubKey)
+		if tx.Version >= 2 {
+			e.uint32(uint32(len(signatures)))
+			for _, sig := range signatures {
+				e.bytes(sig)
+			}
+		}
+	}
+	e.uint32(uint32(len(tx.Vout)))
+	for _, out := range tx.Vout {
+		e.int64(int64(out.Value))
+		if tx.Version >= 3 {
+			e.bytes(out.ScriptPubKey)
+			continue
+		}
+		pubKeyHash, multisig, err := legacyOutputFields(out.ScriptPubKey)
+		if err != nil || (multisig && tx.Version < 2) {
+			log.Panicf("ERROR: Output can not be encoded as a version %d transaction", tx.Version)
+		}
+		e.bytes(pubKeyHash)
+		if tx.Version >= 2 {
+			flag := uint32(0)
+			if multisig {
+				flag = 1
+			}
+			e.uint32(flag)
+		}
+	}
+	if tx.Version >= 4 {
+		e.int64(tx.LockTime)
+	} else if tx.LockTime != 0 {
+		log.Panicf("ERROR: Lock time can not be encoded in a version %d transaction", tx.Version)
+	}
+}
+
+func (d *decoder) transaction() Transaction {
+	var tx Transaction
+
+	tx.Version = int(d.uint32())
+	if tx.Version > txVersion && d.err == nil {
+		d.err = fmt.Errorf("Transaction version %d is not supported", tx.Version)
+	}
+	tx.ID = d.bytes()
+	n := d.count(20)
+	for i := 0; i < n && d.err == nil; i++ {
+		var vin TXInput
+		vin.Txid = d.bytes()
+		vin.Vout = int(d.int64())
+		if tx.Version >= 3 {
+			vin.ScriptSig = d.bytes()
+			tx.Vin = append(tx.Vin, vin)
+			continue
+		}
+		signature := d.bytes()
+		pubKey := d.bytes()
+		var signatures [][]byte
+		if tx.Version >= 2 {
+			m := d.count(4)
+			for j := 0; j < m && d.err == nil; j++ {
+				signatures = append(signatures, d.bytes())
+			}
+		}
+		var err error
+		vin.ScriptSig, err = legacyUnlockingScript(signature, pubKey, signatures)
+		if err == nil && !legacyInputRoundTrips(vin.ScriptSig, signature, pubKey, signatures) {
+			err = errLegacyFields
+		}
+		if err != nil && d.err == nil {
+			d.err = err
+		}
+		tx.Vin = append(tx.Vin, vin)
+	}
+	n = d.count(12)
+	for i := 0; i < n && d.err == nil; i++ {
+		var out TXOutput
+		out.Value = int(d.int64())
+		if tx.Version >= 3 {
+			out.ScriptPubKey = d.bytes()
+			tx.Vout = append(tx.Vout, out)
+			continue
+		}
+		pubKeyHash := d.bytes()
+		multisig := false
+		if tx.Version >= 2 {
+			switch d.uint32() {
+			case 0:
+			case 1:
+				multisig = true
+			default:
+				if d.err == nil {
+					d.err = errors.New("Multisig flag of output must be 0 or 1")
+				}
+			}
+		}
+		out.ScriptPubKey = legacyLockingScript(pubKeyHash, multisig)
+		hash, isMultisig, err := legacyOutputFields(out.ScriptPubKey)
+		if (err != nil || !bytes.Equal(hash, pubKeyHash) || isMultisig != multisig) && d.err == nil {
+			d.err = errLegacyFields
+		}
+		tx.Vout = append(tx.Vout, out)
+	}
+	if tx.Version >= 4 {
+		tx.LockTime = d.int64()
+	}
+
+	return tx
+}
+
+//区块头的编码，nonce单独传入，挖矿时每次尝试只换nonce
+func (e *encoder) blockHeader(h *BlockHeader, nonce int) {
+	e.uint32(uint32(h.Version))
+	e.bytes(h.PrevBlockHash)
+	e.bytes(h.MerkleRoot)
+	e.int64(h.Timestamp)
+	e.int64(int64(h.Bits))
+	e.int64(int64(nonce))
+	e.int64(int64(h.Height))
+}
+
+func (d *decoder) blockHeader(h *BlockHeader) {
+	h.Version = int(d.uint32())
+	if h.Version > blockVersion && d.err == nil {
+		d.err = fmt.Errorf("Block version %d is not supported", h.Version)
+	}
+	h.PrevBlockHash = d.bytes()
+	h.MerkleRoot = d.bytes()
+	h.Timestamp = d.int64()
+	h.Bits = int(d.int64())
+	h.Nonce = int(d.int64())
+	h.Height = int(d.int64())
+}
+
+//gob在一个新进程中第一次编码交易时，放在数值前面的类型定义
+//gob的类型编号是整个进程共用的，同一笔交易在不同的进程中编码出来可能不一样，
+//计算旧交易的ID时统一换成这组类型定义，数值部分的类型编号也统一成这里Transaction的编号64
+const legacyTxTypes = "2\x7f\x03\x01\x01\vTransaction\x01\xff\x80\x00\x01\x03\x01\x02ID\x01\n\x00\x01\x03Vin\x01\xff\x84\x00\x01\x04Vout\x01\xff\x88\x00\x00\x00\x1d\xff\x83\x02\x01\x01\x0e[]main.TXInput\x01\xff\x84\x00\x01\xff\x82\x00\x00@\xff\x81\x03\x01\x01\aTXInput\x01\xff\x82\x00\x01\x04\x01\x04Txid\x01\n\x00\x01\x04Vout\x01\x04\x00\x01\tSignature\x01\n\x00\x01\x06PubKey\x01\n\x00\x00\x00\x1e\xff\x87\x02\x01\x01\x0f[]main.TXOutput\x01\xff\x88\x00\x01\xff\x86\x00\x00/\xff\x85\x03\x01\x01\bTXOutput\x01\xff\x86\x00\x01\x02\x01\x05Value\x01\x04\x00\x01\nPubkeyHash\x01\n\x00\x00\x00"
+
+const legacyTxTypeID = "\xff\x80"
+
+//版本0的交易仍然按gob编码计算ID和Merkle叶子，用和当时一模一样的结构体编码，再换上固定的类型定义
+func (tx Transaction) legacyData() []byte {
+	type TXInput struct {
+		Txid      []byte
+		Vout      int
+		Signature []byte
+		PubKey    []byte
+	}
+	type TXOutput struct {
+		Value      int
+		PubkeyHash []byte
+	}
+	type Transaction struct {
+		ID   []byte
+		Vin  []TXInput
+		Vout []TXOutput
+	}
+
+	if tx.LockTime != 0 {
+		log.Panic("ERROR: Lock time can not be encoded in a version 0 transaction")
+	}
+	legacy := Transaction{ID: tx.ID}
+	for _, vin := range tx.Vin {
+		signature, pubKey, signatures, err := legacyInputFields(vin.ScriptSig)
+		if err != nil || signatures != nil {
+			log.Panic("ERROR: Input can not be encoded as a version 0 transaction")
+		}
+		legacy.Vin = append(legacy.Vin, TXInput{vin.Txid, vin.Vout, signature, pubKey})
+	}
+	for _, out := range tx.Vout {
+		pubKeyHash, multisig, err := legacyOutputFields(out.ScriptPubKey)
+		if err != nil || multisig {
+			log.Panic("ERROR: Output can not be encoded as a version 0 transaction")
+		}
+		legacy.Vout = append(legacy.Vout, TXOutput{out.Value, pubKeyHash})
+	}
+
+	var result bytes.Buffer
+	err := gob.NewEncoder(&result).Encode(legacy)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	//gob的输出是一串带长度的消息，最后一条是数值，开头是类型编号
+	var value []byte
+	for data := result.Bytes(); len(data) > 0; {
+		n, k := gobUint(data)
+		value = data[k : k+int(n)]
+		data = data[k+int(n):]
+	}
+	_, k := gobUint(value)
+	value = append([]byte(legacyTxTypeID), value[k:]...)
+
+	var canonical bytes.Buffer
+	canonical.WriteString(legacyTxTypes)
+	canonical.Write(gobUintBytes(uint64(len(value))))
+	canonical.Write(value)
+
+	return canonical.Bytes()
+}
+
+//读出gob编码的无符号整数，返回它的值和占用的字节数
+//小于128的数只占一个字节，否则第一个字节是后面字节数的相反数，后面是大端序的值
+func gobUint(b []byte) (uint64, int) {
+	if b[0] < 0x80 {
+		return uint64(b[0]), 1
+	}
+	n := int(-int8(b[0]))
+	var v uint64
+	for _, c := range b[1 : n+1] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n + 1
+}
+
+//按gob的方式编码无符号整数
+func gobUintBytes(v uint64) []byte {
+	if v < 0x80 {
+		return []byte{byte(v)}
+	}
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append([]byte{byte(-int8(len(b)))}, b...)
+}
+
+//解码旧数据库中用gob编码的区块，得到的区块和交易的版本都是0
+//当时的输入和输出还没有脚本，先读到和当时一样的结构体里，再换成脚本
+func deserializeLegacyBlock(d []byte) (*Block, error) {
+	var legacy struct {
+		Timestamp    int64
+		Transactions []*struct {
+			ID  []byte
+			Vin []struct {
+				Txid      []byte
+				Vout      int
+				Signature []byte
+				PubKey    []byte
+			}
+			Vout []struct {
+				Value      int
+				PubkeyHash []byte
+			}
+		}
+		PrevBlockHash []byte
+		Hash          []byte
+		Nonce         int
+		Height        int
+		Bits          int
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(d)).Decode(&legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	var transactions []*Transaction
+	for _, ltx := range legacy.Transactions {
+		tx := &Transaction{0, ltx.ID, nil, nil, 0}
+		for _, vin := range ltx.Vin {
+			scriptSig, _ := legacyUnlockingScript(vin.Signature, vin.PubKey, nil)
+			tx.Vin = append(tx.Vin, TXInput{vin.Txid, vin.Vout, scriptSig})
+		}
+		for _, out := range ltx.Vout {
+			tx.Vout = append(tx.Vout, TXOutput{out.Value, legacyLockingScript(out.PubkeyHash, false)})
+		}
+		transactions = append(transactions, tx)
+	}
+
+	block := Block{0, legacy.Timestamp, transactions, legacy.PrevBlockHash, legacy.Hash, legacy.Nonce, legacy.Height, legacy.Bits}
+	return &block, nil
+}
+
+//检查数据库中区块的编码格式，空的链直接记为新格式，gob编码的旧数据库需要先运行migratedb
+func checkDBFormat(b *bolt.Bucket) {
+	if b.Get([]byte("l")) == nil {
+		err := b.Put(dbFormatKey, []byte(dbFormat))
+		if err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+	if string(b.Get(dbFormatKey)) != dbFormat {
+		log.Panic("ERROR: Blockchain database uses the old gob encoding, run migratedb first")
+	}
+}
+
+//把gob编码的旧数据库中的区块改写成新的编码，区块哈希和交易ID都保持不变
+//返回改写的区块数，以及按版本0的规则重新计算后哈希或交易ID对不上的区块
+//这些区块在本地可以照常使用，但其他节点同步时无法通过验证
+func MigrateDB() (int, [][]byte, error) {
+	count := 0
+	var mismatched [][]byte
+
+	db, err := bolt.Open(dbFileName(), 0600, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		if b == nil || b.Get(dbFormatKey) != nil {
+			return nil
+		}
+
+		//bolt在遍历时不能修改桶，先读出来再写回去
+		blocks := make(map[string]*Block)
+		err := b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, []byte("l")) || bytes.Equal(k, utxoFormatKey) {
+				return nil
+			}
+			block, err := deserializeLegacyBlock(v)
+			if err != nil {
+				return fmt.Errorf("Block %x can not be decoded: %s", k, err)
+			}
+			blocks[string(k)] = block
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, block := range blocks {
+			err := b.Put([]byte(k), block.Serialize())
+			if err != nil {
+				return err
+			}
+			if !legacyBlockReproducible(block) {
+				mismatched = append(mismatched, block.Hash)
+			}
+		}
+		count = len(blocks)
+
+		return b.Put(dbFormatKey, []byte(dbFormat))
+	})
+
+	return count, mismatched, err
+}
+
+//按版本0的规则重新计算区块哈希和交易ID，看是否和保存的一致
+//交易ID是在签名之前算出来的，计算时要去掉签名，见ComputeID
+func legacyBlockReproducible(block *Block) bool {
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ComputeID(), tx.ID) {
+			return false
+		}
+	}
+	return bytes.Equal(block.Header().Hash(), block.Hash)
+}
+
+//版本3之前的输出换成同样效果的锁定脚本：PubkeyHash对应P2PKH，Multisig为true时对应P2SH
+func legacyLockingScript(pubKeyHash []byte, multisig bool) []byte {
+	if multisig {
+		return PayToScriptHashScript(pubKeyHash)
+	}
+	return PayToPubKeyHashScript(pubKeyHash)
+}
+
+//从锁定脚本换回版本3之前的输出字段，只有P2PKH和P2SH脚本可以
+func legacyOutputFields(script []byte) ([]byte, bool, error) {
+	switch kind, hash := classifyScript(script); kind {
+	case scriptPubKeyHash:
+		return hash, false, nil
+	case scriptScriptHash:
+		return hash, true, nil
+	}
+	return nil, false, errors.New("Script is not a pay-to-pubkey-hash or pay-to-script-hash script")
+}
+
+//版本3之前的输入换成同样效果的解锁脚本
+//普通的输入是 <Signature> <PubKey>；多重签名的输入Signature是空的，换成 OP_0 <Signatures...> <PubKey>
+func legacyUnlockingScript(signature, pubKey []byte, signatures [][]byte) ([]byte, error) {
+	if len(signatures) == 0 {
+		return pubKeyHashUnlockingScript(signature, pubKey), nil
+	}
+	if len(signature) != 0 {
+		return nil, errors.New("Input has both a signature and multisig signatures")
+	}
+	return multisigUnlockingScript(signatures, pubKey), nil
+}
+
+//版本3之前的交易中，有的字段换成脚本以后换不回原来的字段：公钥哈希不是20字节，或者数据超过了OP_PUSHDATA2能压入的0xffff字节
+//这样的交易没法再编码，计算ID和哈希时会出错，解码时直接拒绝
+var errLegacyFields = errors.New("Transaction fields can not be encoded as scripts before version 3")
+
+//版本3之前的输入换成解锁脚本以后，能不能换回同样的字段
+func legacyInputRoundTrips(script, signature, pubKey []byte, signatures [][]byte) bool {
+	sig, key, sigs, err := legacyInputFields(script)
+	if err != nil || !bytes.Equal(sig, signature) || !bytes.Equal(key, pubKey) || len(sigs) != len(signatures) {
+		return false
+	}
+	for i := range sigs {
+		if !bytes.Equal(sigs[i], signatures[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//从解锁脚本换回版本3之前的输入字段，空的解锁脚本对应字段都是空的（签名时的交易副本）
+func legacyInputFields(script []byte) ([]byte, []byte, [][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, op := range ops {
+		if !op.isPush() {
+			return nil, nil, nil, ErrScriptSigNoPush
+		}
+	}
+
+	switch {
+	case len(ops) == 0:
+		return nil, nil, nil, nil
+	case len(ops) == 2:
+		return ops[0].data, ops[1].data, nil, nil
+	case len(ops) >= 3 && ops[0].opcode == OP_0:
+		signatures, pubKey, _ := parseMultisigUnlockingScript(script)
+		return nil, pubKey, signatures, nil
+	}
+	return nil, nil, nil, errors.New("Script can not be encoded as an input before version 3")
+}
+
+//UTXO集合、撤销数据和交易池是用gob保存的，版本3之前保存的输出和输入没有脚本，读出来时要先换成脚本
+type storedOutput struct {
+	Value        int
+	ScriptPubKey []byte
+	PubkeyHash   []byte
+	Multisig     bool
+}
+
+func (out storedOutput) output() TXOutput {
+	if out.ScriptPubKey == nil && (out.PubkeyHash != nil || out.Multisig) {
+		return TXOutput{out.Value, legacyLockingScript(out.PubkeyHash, out.Multisig)}
+	}
+	return TXOutput{out.Value, out.ScriptPubKey}
+}
+
+type storedInput struct {
+	Txid       []byte
+	Vout       int
+	ScriptSig  []byte
+	Signature  []byte
+	PubKey     []byte
+	Signatures [][]byte
+}
+
+func (in storedInput) input() TXInput {
+	if in.ScriptSig == nil && (in.Signature != nil || in.PubKey != nil || in.Signatures != nil) {
+		scriptSig, _ := legacyUnlockingScript(in.Signature, in.PubKey, in.Signatures)
+		return TXInput{in.Txid, in.Vout, scriptSig}
+	}
+	return TXInput{in.Txid, in.Vout, in.ScriptSig}
+}
+
+type storedTransaction struct {
+	Version  int
+	ID       []byte
+	Vin      []storedInput
+	Vout     []storedOutput
+	LockTime int64
+}
+
+func (stx storedTransaction) transaction() Transaction {
+	tx := Transaction{stx.Version, stx.ID, nil, nil, stx.LockTime}
+	for _, in := range stx.Vin {
+		tx.Vin = append(tx.Vin, in.input())
+	}
+	for _, out := range stx.Vout {
+		tx.Vout = append(tx.Vout, out.output())
+	}
+	return tx
+}
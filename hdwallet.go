@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/big"
+	"github.com/tyler-smith/go-bip39"
+)
+
+/*HD（分层确定性）钱包
+所有地址的私钥都由同一个种子按BIP44的路径 m/44'/coin'/0'/0/i 派生出来，i从0开始递增
+种子由BIP39助记词生成，只要抄下助记词，就能恢复这个钱包生成过的所有地址
+我们的密钥用的是P-256曲线而不是比特币的secp256k1，所以按照SLIP-0010中P-256的规则派生
+*/
+const (
+	hdPurpose  = 44
+	hdCoinType = 1 //没有注册的币种，和测试网一样用1
+	hdAccount  = 0
+	hdHardened = 0x80000000
+
+	//恢复钱包时，连续这么多个地址在链上都没有出现过，就认为后面的地址也没有被用过
+	hdGapLimit = 20
+
+	//助记词的熵，128位是12个单词
+	mnemonicEntropyBits = 128
+)
+
+//SLIP-0010中P-256主密钥的HMAC密钥
+var hdSeedKey = []byte("Nist256p1 seed")
+
+var (
+	ErrWalletHD        = errors.New("Wallet already has an HD seed")
+	ErrInvalidMnemonic = errors.New("Mnemonic is not valid")
+)
+
+//派生过程中的一个扩展私钥
+type hdKey struct {
+	Key       []byte
+	ChainCode []byte
+}
+
+//生成一组新的助记词
+func NewMnemonic() string {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		log.Panic(err)
+	}
+	mnemonic, err := bip39.NewMnemonic(entropy)
+	if err != nil {
+		log.Panic(err)
+	}
+	return mnemonic
+}
+
+//由助记词得到种子，助记词的校验和不对时返回ErrInvalidMnemonic
+func mnemonicToSeed(mnemonic string) ([]byte, error) {
+	if !bip39.IsMnemonicValid(mnemonic) {
+		return nil, ErrInvalidMnemonic
+	}
+	return bip39.NewSeed(mnemonic, ""), nil
+}
+
+//由种子得到主密钥，得到的私钥无效时用上一次的结果重新计算
+func newMasterKey(seed []byte) hdKey {
+	data := seed
+	for {
+		mac := hmac.New(sha512.New, hdSeedKey)
+		mac.Write(data)
+		I := mac.Sum(nil)
+
+		k := new(big.Int).SetBytes(I[:32])
+		if k.Sign() > 0 && k.Cmp(elliptic.P256().Params().N) < 0 {
+			return hdKey{I[:32], I[32:]}
+		}
+		data = I
+	}
+}
+
+//派生第index个子私钥，index >= hdHardened时是强化派生，子密钥不能由父公钥推出
+func (k hdKey) child(index uint32) hdKey {
+	curve := elliptic.P256()
+	n := curve.Params().N
+
+	var data []byte
+	if index >= hdHardened {
+		data = append([]byte{0}, padKey(k.Key)...)
+	} else {
+		x, y := curve.ScalarBaseMult(k.Key)
+		data = elliptic.MarshalCompressed(curve, x, y)
+	}
+	data = append(data, ser32(index)...)
+
+	for {
+		mac := hmac.New(sha512.New, k.ChainCode)
+		mac.Write(data)
+		I := mac.Sum(nil)
+
+		IL := new(big.Int).SetBytes(I[:32])
+		childKey := new(big.Int).Add(IL, new(big.Int).SetBytes(k.Key))
+		childKey.Mod(childKey, n)
+		if IL.Cmp(n) < 0 && childKey.Sign() != 0 {
+			return hdKey{padKey(childKey.Bytes()), I[32:]}
+		}
+		//SLIP-0010：结果无效时用 0x01 || IR || index 再算一次
+		data = append(append([]byte{1}, I[32:]...), ser32(index)...)
+	}
+}
+
+//4字节大端序的index
+func ser32(index uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, index)
+	return buf
+}
+
+//私钥补足32字节
+func padKey(key []byte) []byte {
+	padded := make([]byte, 32)
+	copy(padded[32-len(key):], key)
+	return padded
+}
+
+//按路径 m/44'/coin'/0'/0/index 派生出一个地址的私钥
+func deriveHDKey(seed []byte, index int) ecdsa.PrivateKey {
+	key := newMasterKey(seed).
+		child(hdHardened + hdPurpose).
+		child(hdHardened + hdCoinType).
+		child(hdHardened + hdAccount).
+		child(0).
+		child(uint32(index))
+
+	return privateKeyFromD(key.Key)
+}
+
+//钱包是否是HD钱包
+func (ws *Wallets) IsHD() bool {
+	return ws.seed != nil || ws.sealedSeed != nil
+}
+
+//用助记词把钱包设置成HD钱包，之后CreateWallet创建的地址都由助记词派生
+//钱包里之前随机生成的地址不受助记词保护，仍然要单独备份
+func (ws *Wallets) SetMnemonic(mnemonic string) error {
+	if ws.IsHD() {
+		return ErrWalletHD
+	}
+
+	seed, err := mnemonicToSeed(mnemonic)
+	if err != nil {
+		return err
+	}
+	ws.seed = seed
+	ws.nextIndex = 0
+
+	return nil
+}
+
+//派生下一个HD地址
+func (ws *Wallets) deriveNext() *Wallet {
+	if ws.seed == nil {
+		log.Panic(ErrWalletLocked)
+	}
+
+	private := deriveHDKey(ws.seed, ws.nextIndex)
+	ws.nextIndex++
+	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+
+	return &Wallet{private, pubKey}
+}
+
+//恢复HD钱包：依次派生地址，直到连续hdGapLimit个地址都没有在链上出现过
+//used判断一个公钥哈希是否在链上出现过，返回恢复出的地址，至少有一个
+func (ws *Wallets) RestoreHD(used func(pubKeyHash []byte) bool) []string {
+	var addresses []string
+	var derived []*Wallet
+	lastUsed := -1
+
+	for i := 0; i-lastUsed <= hdGapLimit; i++ {
+		wallet := ws.deriveNext()
+		derived = append(derived, wallet)
+		if used(HashPubKey(wallet.PublicKey)) {
+			lastUsed = i
+		}
+	}
+
+	//只保留到最后一个用过的地址为止，一个都没用过时保留第一个
+	keep := lastUsed + 1
+	if keep == 0 {
+		keep = 1
+	}
+	for _, wallet := range derived[:keep] {
+		address := string(wallet.GetAddress())
+		ws.Wallets[address] = wallet
+		addresses = append(addresses, address)
+	}
+	ws.nextIndex = keep
+
+	return addresses
+}
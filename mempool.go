@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+//持久化交易池的桶，也放在区块链的数据库文件里
+const mempoolBucket = "mempool"
+
+//一个区块最多能打包的交易数据大小（字节），不包括coinbase交易
+const maxBlockTxSize = 100000
+
+//交易池拒绝交易时返回的错误
+var (
+	ErrTxInPool      = errors.New("Transaction is already in the mempool")
+	ErrTxCoinbase    = errors.New("Coinbase transaction can not be added to the mempool")
+	ErrTxBadID       = errors.New("Transaction ID does not match its contents")
+	ErrTxVersion     = errors.New("Transaction version is older than the current version")
+	ErrTxIDExists    = errors.New("Transaction ID already has unspent outputs")
+	ErrTxMissingUTXO = errors.New("Transaction input is not found or already spent")
+	ErrTxConflict    = errors.New("Transaction input is already spent by another transaction in the mempool")
+	ErrTxValue       = errors.New("Transaction output value is negative, too large or more than its inputs")
+	ErrTxSignature   = errors.New("Transaction signature is not valid")
+	ErrTxLockTime    = errors.New("Transaction or an output it spends is locked until a later block height or time")
+	ErrTxImmature    = errors.New("Transaction spends a coinbase output that is not mature yet")
+)
+
+//交易池里的一条记录，Fee是交易的手续费，Time是交易进入交易池的时间
+//挖矿时手续费率高的交易先被打包，手续费率一样时先进来的先被打包
+type mempoolEntry struct {
+	Tx   Transaction
+	Time int64
+	Fee  int
+}
+
+//每字节的手续费
+func (entry mempoolEntry) feeRate() float64 {
+	return float64(entry.Fee) / float64(len(entry.Tx.Serialize()))
+}
+
+//交易池，存放已经通过验证、等待被打包进区块的交易
+//比特币并不是收到一笔交易就马上挖一个区块，而是把交易放进交易池，矿工挖矿时再从交易池取出一批交易
+type Mempool struct {
+	entries    map[string]mempoolEntry
+	spent      map[string]string //被交易池中的交易花费的输出（交易ID:输出索引） -> 花费它的交易ID
+	bc         *Blockchain
+	persistent bool //为true时交易池同时保存在数据库里，命令行每次运行都是一个新进程，需要靠它保存交易池
+	tip        []byte //交易池上次和区块链同步时的顶端区块，见Sync
+}
+
+//创建交易池，persistent为true时从数据库中加载之前保存的交易
+func NewMempool(bc *Blockchain, persistent bool) *Mempool {
+	mp := Mempool{make(map[string]mempoolEntry), make(map[string]string), bc, persistent, bc.tip}
+	if !persistent {
+		return &mp
+	}
+
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(mempoolBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			entry := deserializeMempoolEntry(v)
+			mp.index(entry)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	//保存的交易的输入可能已经被之后挖出的区块花费了，加载时把这些交易去掉
+	UTXOSet := UTXOSet{bc}
+	for _, entry := range mp.entries {
+		for _, vin := range entry.Tx.Vin {
+			if _, ok := UTXOSet.FindOutput(vin.Txid, vin.Vout); !ok {
+				mp.Remove(entry.Tx.ID)
+				break
+			}
+		}
+	}
+
+	return &mp
+}
+
+//输出在spent中的键
+func outpointKey(txID []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txID, vout)
+}
+
+//把一条记录加到内存中的索引里
+func (mp *Mempool) index(entry mempoolEntry) {
+	txID := hex.EncodeToString(entry.Tx.ID)
+	mp.entries[txID] = entry
+	for _, vin := range entry.Tx.Vin {
+		mp.spent[outpointKey(vin.Txid, vin.Vout)] = txID
+	}
+}
+
+//验证一笔交易并把它加入交易池
+//交易的每个输入都必须引用UTXO集合中存在的输出，不能和交易池中的其他交易花费同一个输出，解锁脚本也必须正确
+//交易和它花费的输出的时间锁按下一个区块检查，还没到时间的交易不会被接收
+//交易ID必须是按ComputeID算出来的，并且在UTXO集合中还没有未花费的输出，见checkBlock和checkBlockTransactions
+//交易版本必须是当前的txVersion
+func (mp *Mempool) Add(tx *Transaction) error {
+	return mp.add(tx, time.Now().UnixNano())
+}
+
+//验证一笔交易并把它加入交易池，added是交易进入交易池的时间
+func (mp *Mempool) add(tx *Transaction, added int64) error {
+	txID := hex.EncodeToString(tx.ID)
+
+	if tx.IsCoinbase() {
+		return ErrTxCoinbase
+	}
+	//旧版本的交易只能出现在之前保存的旧区块里
+	if tx.Version < txVersion {
+		return ErrTxVersion
+	}
+	if !bytes.Equal(tx.ComputeID(), tx.ID) {
+		return ErrTxBadID
+	}
+	if _, ok := mp.entries[txID]; ok {
+		return ErrTxInPool
+	}
+
+	height := mp.bc.GetBestHeight() + 1
+	now := time.Now().Unix()
+	if !tx.IsFinal(height, now) {
+		return ErrTxLockTime
+	}
+
+	UTXOSet := UTXOSet{mp.bc}
+	if _, ok := UTXOSet.FindOutputs(tx.ID); ok {
+		return ErrTxIDExists
+	}
+	inputValue := 0
+	seen := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		//同一笔交易里两个输入引用同一个输出也算冲突
+		if seen[key] {
+			return ErrTxConflict
+		}
+		seen[key] = true
+
+		if _, ok := mp.spent[key]; ok {
+			return ErrTxConflict
+		}
+		outs, _ := UTXOSet.FindOutputs(vin.Txid)
+		out, ok := outs.Outputs[vin.Vout]
+		if !ok {
+			return ErrTxMissingUTXO
+		}
+		if !outs.IsMature(height) {
+			return ErrTxImmature
+		}
+		if !timeLockReady(out.ScriptPubKey, outs.Height, height, now) {
+			return ErrTxLockTime
+		}
+		inputValue += out.Value
+	}
+
+	//和区块中的交易一样，输出金额不能是负数，总额不能超过币的总量上限，见outputsValue
+	outputValue, ok := outputsValue(tx)
+	if !ok || outputValue > inputValue {
+		return ErrTxValue
+	}
+
+	if !mp.bc.VerifyTransaction(tx) {
+		return ErrTxSignature
+	}
+
+	entry := mempoolEntry{*tx, added, inputValue - outputValue}
+	mp.index(entry)
+	if mp.persistent {
+		err := mp.bc.db.Update(func(btx *bolt.Tx) error {
+			b := btx.Bucket([]byte(mempoolBucket))
+			return b.Put(tx.ID, entry.serialize())
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return nil
+}
+
+//通过交易ID从交易池中取出一笔交易
+func (mp *Mempool) Get(txID []byte) (Transaction, bool) {
+	entry, ok := mp.entries[hex.EncodeToString(txID)]
+	return entry.Tx, ok
+}
+
+//交易池中是否有这笔交易
+func (mp *Mempool) Has(txID []byte) bool {
+	_, ok := mp.entries[hex.EncodeToString(txID)]
+	return ok
+}
+
+//交易池中的交易数
+func (mp *Mempool) Count() int {
+	return len(mp.entries)
+}
+
+//某个输出是否已经被交易池中的交易花费了
+func (mp *Mempool) IsSpent(txID []byte, vout int) bool {
+	_, ok := mp.spent[outpointKey(txID, vout)]
+	return ok
+}
+
+//从交易池中移除一笔交易
+func (mp *Mempool) Remove(txID []byte) {
+	key := hex.EncodeToString(txID)
+	entry, ok := mp.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(mp.entries, key)
+	for _, vin := range entry.Tx.Vin {
+		delete(mp.spent, outpointKey(vin.Txid, vin.Vout))
+	}
+
+	if mp.persistent {
+		err := mp.bc.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(mempoolBucket))
+			return b.Delete(txID)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+/*顶端区块变了以后，让交易池和新的UTXO集合保持一致
+1.	从交易池上次同步时的顶端往回走，直到主链上的区块，这些区块被分叉切换回滚了，它们的交易（coinbase除外）放回交易池
+2.	交易池中所有的交易按新的UTXO集合重新验证，已经上链的、和链上的交易冲突的、引用的输出被回滚掉的交易都被移除
+交易池不接收花费交易池中其他交易的输出的交易，所以被回滚的区块中花费同一区块里前面交易输出的交易放不回来
+*/
+func (mp *Mempool) Sync() {
+	if bytes.Equal(mp.tip, mp.bc.tip) {
+		return
+	}
+
+	var disconnected []*Transaction
+	err := mp.bc.db.View(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+		heights := tx.Bucket([]byte(heightBucket))
+		for hash := mp.tip; len(hash) != 0; {
+			header := getHeader(tx, hash)
+			if header == nil || bytes.Equal(heights.Get(heightKey(header.Height)), hash) {
+				break
+			}
+			//往回走时得到的区块是从高到低的，放回交易池要按上链的顺序
+			block := DeserializeBlock(blocks.Get(hash))
+			disconnected = append(append([]*Transaction{}, block.Transactions[1:]...), disconnected...)
+			hash = header.PrevBlockHash
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var entries []mempoolEntry
+	for _, entry := range mp.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time < entries[j].Time
+	})
+	for _, entry := range entries {
+		mp.Remove(entry.Tx.ID)
+	}
+	mp.tip = mp.bc.tip
+
+	for _, tx := range disconnected {
+		if err := mp.Add(tx); err == nil {
+			fmt.Printf("Transaction %x of a disconnected block is back in the mempool\n", tx.ID)
+		}
+	}
+	for i := range entries {
+		//已经被打包进区块的交易就不用打印了
+		if err := mp.add(&entries[i].Tx, entries[i].Time); err != nil && err != ErrTxIDExists {
+			fmt.Printf("Transaction %x removed from the mempool: %s\n", entries[i].Tx.ID, err)
+		}
+	}
+}
+
+//挖矿时从交易池中取出一批交易，按手续费率从高到低选择，总大小不超过maxSize
+//LockTime还没到的交易留在交易池里，返回选中的交易和它们的手续费总额
+func (mp *Mempool) Select(maxSize int) ([]*Transaction, int) {
+	height := mp.bc.GetBestHeight() + 1
+	now := time.Now().Unix()
+	var entries []mempoolEntry
+	for _, entry := range mp.entries {
+		if entry.Tx.IsFinal(height, now) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].feeRate() != entries[j].feeRate() {
+			return entries[i].feeRate() > entries[j].feeRate()
+		}
+		return entries[i].Time < entries[j].Time
+	})
+
+	var txs []*Transaction
+	size := 0
+	fees := 0
+	for i := range entries {
+		txSize := len(entries[i].Tx.Serialize())
+		if size+txSize > maxSize {
+			continue
+		}
+		size += txSize
+		fees += entries[i].Fee
+		txs = append(txs, &entries[i].Tx)
+	}
+
+	return txs, fees
+}
+
+//挖矿：从交易池中取出一批交易，和奖励给矿工的coinbase交易一起打包进一个新区块
+//coinbase交易放在区块的Transactions的第一个位置，矿工同时领取这些交易的手续费
+//挖矿期间顶端区块变了就在新的顶端上重新组装区块再挖，ctx被取消时返回取消的原因
+func (mp *Mempool) Mine(ctx context.Context, minerAddress string) (*Block, error) {
+	for {
+		newBlock, err := mp.bc.MineBlock(ctx, mp.NewCandidateTransactions(minerAddress))
+		if err == ErrTipChanged {
+			fmt.Printf("Mining aborted: %s, rebuilding block on the new tip\n", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		mp.Sync()
+
+		return newBlock, nil
+	}
+}
+
+//从交易池中取出一批交易，加上奖励给矿工的coinbase交易，作为下一个区块的交易
+func (mp *Mempool) NewCandidateTransactions(minerAddress string) []*Transaction {
+	selected, fees := mp.Select(maxBlockTxSize)
+	cbTx := NewCoinbaseTX(minerAddress, "", mp.bc.GetBestHeight()+1, fees)
+	return append([]*Transaction{cbTx}, selected...)
+}
+
+//序列化交易池中的一条记录
+func (entry mempoolEntry) serialize() []byte {
+	var result bytes.Buffer
+
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(entry)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+//反序列化交易池中的一条记录，版本3之前保存的交易换成脚本，见storedTransaction
+func deserializeMempoolEntry(data []byte) mempoolEntry {
+	var stored struct {
+		Tx   storedTransaction
+		Time int64
+		Fee  int
+	}
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&stored)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return mempoolEntry{stored.Tx.transaction(), stored.Time, stored.Fee}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+//Merkle树，每个区块都会构建一棵，叶子节点是区块里每笔交易序列化后的哈希
+//树的根哈希作为区块所有交易的唯一表示，在工作量证明中使用
+//这样只要有根哈希和一条从叶子到根的路径，就能证明某笔交易在区块里，而不用下载区块的所有交易
+type MerkleTree struct {
+	RootNode *MerkleNode
+	levels   [][]*MerkleNode //从叶子层到根的每一层节点，生成包含证明时要用到
+	mutated  bool            //某一层有两个相同的兄弟节点，见NewMerkleTree
+}
+
+//Merkle树的节点，Data存储的是该节点的哈希
+type MerkleNode struct {
+	Left  *MerkleNode
+	Right *MerkleNode
+	Data  []byte
+}
+
+//交易的Merkle包含证明
+//Hashes是从叶子往上每一层兄弟节点的哈希，Index是交易在区块中的位置
+//Index的每一个二进制位决定了对应层的兄弟节点在左边还是右边
+type MerkleProof struct {
+	TxID   []byte
+	Index  int
+	Hashes [][]byte
+}
+
+//创建一个节点，叶子节点直接对数据做哈希，非叶子节点对左右两个子节点哈希的拼接做哈希
+func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	mNode := MerkleNode{}
+
+	if left == nil && right == nil {
+		hash := sha256.Sum256(data)
+		mNode.Data = hash[:]
+	} else {
+		prevHashes := append(append([]byte{}, left.Data...), right.Data...)
+		hash := sha256.Sum256(prevHashes)
+		mNode.Data = hash[:]
+	}
+
+	mNode.Left = left
+	mNode.Right = right
+
+	return &mNode
+}
+
+//用一组数据创建Merkle树
+//和比特币一样，某一层节点数是奇数时，把最后一个节点复制一份和自己配对
+//所以在末尾把最后一段子树再重复一次，算出的根哈希不变（CVE-2012-2459），
+//这时一定有两个相同的兄弟节点，记在mutated里，这样的交易列表不是区块原来的交易列表
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	var nodes []*MerkleNode
+
+	for _, datum := range data {
+		node := NewMerkleNode(nil, nil, datum)
+		nodes = append(nodes, node)
+	}
+	//没有数据时只有一个空数据的叶子
+	if len(nodes) == 0 {
+		nodes = append(nodes, NewMerkleNode(nil, nil, []byte{}))
+	}
+
+	levels := [][]*MerkleNode{nodes}
+	mutated := false
+	for len(nodes) > 1 {
+		var newLevel []*MerkleNode
+
+		for j := 0; j < len(nodes); j += 2 {
+			left := nodes[j]
+			right := left
+			if j+1 < len(nodes) {
+				right = nodes[j+1]
+				mutated = mutated || bytes.Equal(left.Data, right.Data)
+			}
+			newLevel = append(newLevel, NewMerkleNode(left, right, nil))
+		}
+
+		nodes = newLevel
+		levels = append(levels, nodes)
+	}
+
+	return &MerkleTree{nodes[0], levels, mutated}
+}
+
+//生成第index个叶子的包含证明，只包含每一层兄弟节点的哈希
+func (t *MerkleTree) Proof(index int) ([][]byte, error) {
+	if index < 0 || index >= len(t.levels[0]) {
+		return nil, errors.New("Merkle leaf index out of range")
+	}
+
+	var hashes [][]byte
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		//奇数层的最后一个节点和自己配对
+		if sibling >= len(level) {
+			sibling = index
+		}
+		hashes = append(hashes, level[sibling].Data)
+		index /= 2
+	}
+
+	return hashes, nil
+}
+
+//用包含证明从叶子数据一路算到根，再和给出的根哈希比较
+//index必须小于2^len(hashes)；奇数层复制出来的最后一个节点不是真的节点，
+//兄弟节点的哈希和自己一样的右节点就是这种复制，不接受，否则同一笔交易可以换一个Index再证明一次
+//叶子和非叶子节点的哈希算法一样，64字节的叶子分不清是不是两个子节点哈希的拼接，也不接受
+func VerifyMerkleProof(merkleRoot []byte, leaf []byte, index int, hashes [][]byte) bool {
+	if index < 0 || len(leaf) == 2*sha256.Size {
+		return false
+	}
+	hash := sha256.Sum256(leaf)
+	current := hash[:]
+
+	for _, sibling := range hashes {
+		if index%2 == 1 && bytes.Equal(sibling, current) {
+			return false
+		}
+		var data []byte
+		if index%2 == 0 {
+			data = append(append(data, current...), sibling...)
+		} else {
+			data = append(append(data, sibling...), current...)
+		}
+		hash = sha256.Sum256(data)
+		current = hash[:]
+		index /= 2
+	}
+
+	return index == 0 && bytes.Equal(current, merkleRoot)
+}
+
+//验证交易tx是否被包含在Merkle根为merkleRoot的区块中
+func (p *MerkleProof) Verify(merkleRoot []byte, tx *Transaction) bool {
+	if !bytes.Equal(p.TxID, tx.ID) {
+		return false
+	}
+	return VerifyMerkleProof(merkleRoot, tx.hashData(), p.Index, p.Hashes)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+)
+
+/*多重签名（m-of-n）
+多重签名的赎回脚本是 OP_m <公钥1> ... <公钥n> OP_n OP_CHECKMULTISIG，输出用P2SH锁定到赎回脚本的哈希，
+地址是 Base58(params.ScriptHashAddrID + 脚本哈希 + 校验位)，脚本的执行见script.go
+花费时解锁脚本是 OP_0 <签名1> ... <签名n> <赎回脚本>，签名按脚本中公钥的顺序每个公钥一个位置
+每个持有其中一个私钥的钱包依次（或者各自）签上自己的位置，有m个有效签名以后交易才能通过验证
+
+版本2的交易还没有脚本，赎回脚本是下面的旧格式，编码方式见encoding.go，用它创建的地址仍然可以花费：
+
+	u32 M + list(bytes 公钥)
+*/
+
+//一个多重签名脚本最多的公钥数
+const maxMultisigKeys = 15
+
+var (
+	ErrBadMultisig       = errors.New("Multisig needs 1 <= m <= n <= 15 distinct valid public keys")
+	ErrUnknownMultisig   = errors.New("Multisig address is not in the wallet, run createmultisig first")
+	ErrMultisigMismatch  = errors.New("Transactions to combine are not the same transaction")
+	ErrNotEnoughMultisig = errors.New("Multisig input does not have enough valid signatures")
+)
+
+//多重签名脚本，data是从旧格式读出来时的原始数据
+type MultisigScript struct {
+	M       int
+	PubKeys [][]byte
+	data    []byte
+}
+
+//创建一个m-of-n的多重签名脚本，公钥的顺序决定了地址
+func NewMultisigScript(m int, pubKeys [][]byte) (*MultisigScript, error) {
+	script := &MultisigScript{m, pubKeys, nil}
+	if !script.valid() {
+		return nil, ErrBadMultisig
+	}
+	return script, nil
+}
+
+//检查m和n的范围，公钥要在曲线上并且不能重复
+func (s *MultisigScript) valid() bool {
+	if s.M < 1 || s.M > len(s.PubKeys) || len(s.PubKeys) > maxMultisigKeys {
+		return false
+	}
+	curve := elliptic.P256()
+	seen := make(map[string]bool)
+	for _, pubKey := range s.PubKeys {
+		x := new(big.Int).SetBytes(pubKey[:len(pubKey)/2])
+		y := new(big.Int).SetBytes(pubKey[len(pubKey)/2:])
+		if len(pubKey) == 0 || !curve.IsOnCurve(x, y) || seen[string(pubKey)] {
+			return false
+		}
+		seen[string(pubKey)] = true
+	}
+	return true
+}
+
+//多重签名的赎回脚本
+func (s *MultisigScript) script() []byte {
+	script := opInt(int64(s.M))
+	for _, pubKey := range s.PubKeys {
+		script = append(script, opPush(pubKey)...)
+	}
+	script = append(script, opInt(int64(len(s.PubKeys)))...)
+	return append(script, OP_CHECKMULTISIG)
+}
+
+//序列化多重签名脚本，也就是花费时放在解锁脚本最后的赎回脚本，从旧格式读出来的脚本保持原样，这样地址不会变
+func (s *MultisigScript) Serialize() []byte {
+	if s.data != nil {
+		return s.data
+	}
+	return s.script()
+}
+
+//反序列化多重签名脚本，格式不对或者脚本无效时返回错误
+func DeserializeMultisigScript(data []byte) (*MultisigScript, error) {
+	if s, err := decodeLegacyMultisig(data); err == nil {
+		return s, nil
+	}
+
+	ops, err := parseScript(data)
+	if err != nil {
+		return nil, err
+	}
+	n := len(ops) - 3
+	if n < 1 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG ||
+		!bytes.Equal(opInt(int64(n)), []byte{ops[len(ops)-2].opcode}) {
+		return nil, ErrBadMultisig
+	}
+	m := int(ops[0].opcode) - OP_1 + 1
+	var pubKeys [][]byte
+	for _, op := range ops[1 : n+1] {
+		if !op.isPush() {
+			return nil, ErrBadMultisig
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+
+	s, err := NewMultisigScript(m, pubKeys)
+	if err != nil {
+		return nil, err
+	}
+	//同样的m和公钥只有一种编码，否则同一组公钥会有好几个地址
+	if !bytes.Equal(s.script(), data) {
+		return nil, ErrBadMultisig
+	}
+	return s, nil
+}
+
+//读出版本2时期的旧格式多重签名脚本
+func decodeLegacyMultisig(data []byte) (*MultisigScript, error) {
+	var s MultisigScript
+
+	d := &decoder{data: data}
+	s.M = int(d.uint32())
+	n := d.count(4)
+	for i := 0; i < n && d.err == nil; i++ {
+		s.PubKeys = append(s.PubKeys, d.bytes())
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	if !s.valid() {
+		return nil, ErrBadMultisig
+	}
+	s.data = data
+
+	return &s, nil
+}
+
+//脚本的哈希，和公钥哈希一样是RIPEMD160(SHA256(脚本))
+func (s *MultisigScript) Hash() []byte {
+	return HashPubKey(s.Serialize())
+}
+
+//多重签名地址
+func (s *MultisigScript) Address() string {
+	return hashToAddress(params.ScriptHashAddrID, s.Hash())
+}
+
+//公钥在脚本中的位置，不在脚本中返回-1
+func (s *MultisigScript) keyIndex(pubKey []byte) int {
+	for i, key := range s.PubKeys {
+		if bytes.Equal(key, pubKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+//把多重签名脚本加入钱包，之后就可以用它的地址创建交易了，返回多重签名地址
+func (ws *Wallets) AddMultisig(script *MultisigScript) string {
+	address := script.Address()
+	ws.multisig[address] = script.Serialize()
+	return address
+}
+
+//钱包中多重签名地址的脚本
+func (ws *Wallets) GetMultisig(address string) (*MultisigScript, error) {
+	data, ok := ws.multisig[address]
+	if !ok {
+		return nil, ErrUnknownMultisig
+	}
+	return DeserializeMultisigScript(data)
+}
+
+//创建一笔花费多重签名地址from的交易，找零回到from
+//交易还没有签名，要由持有私钥的钱包用SignMultisigTransaction签上足够的签名
+func NewMultisigTransaction(script *MultisigScript, to string, amount, fee int, UTXOSet *UTXOSet, mempool *Mempool) *Transaction {
+	var inputs []TXInput
+	var outputs []TXOutput
+
+	if amount <= 0 || fee < 0 {
+		log.Panic("ERROR: Amount must be positive and fee can not be negative")
+	}
+
+	from := script.Address()
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(script.Hash(), amount+fee, mempool)
+	if acc < amount+fee {
+		log.Panic("ERROR: Not enough funds")
+	}
+
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		if err != nil {
+			log.Panic(err)
+		}
+		for _, out := range outs {
+			inputs = append(inputs, TXInput{txID, out, nil})
+		}
+	}
+
+	outputs = append(outputs, *NewTXOutput(amount, to))
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
+	}
+
+	//和其他交易一样，ID是在解锁脚本为空时算出来的，见ComputeID
+	//之后每个输入放上还没有签名的多重签名解锁脚本，签名的钱包从里面读出多重签名脚本
+	tx := Transaction{txVersion, nil, inputs, outputs, 0}
+	tx.ID = tx.Hash()
+	for inID := range tx.Vin {
+		tx.Vin[inID].ScriptSig = multisigUnlockingScript(make([][]byte, len(script.PubKeys)), script.Serialize())
+	}
+
+	return &tx
+}
+
+//用钱包中的私钥给多重签名输入签名，每个输入签上脚本中属于这个钱包的所有公钥的位置
+//已经签过的位置不会再签，返回新签上的签名数
+func (tx *Transaction) SignMultisig(wallets *Wallets, prevTXs map[string]Transaction) int {
+	signed := 0
+
+	for inID, vin := range tx.Vin {
+		prevOut := prevTXs[hex.EncodeToString(vin.Txid)].Vout[vin.Vout]
+		_, _, lockingScript := splitTimeLock(prevOut.ScriptPubKey)
+		if kind, _ := classifyScript(lockingScript); kind != scriptScriptHash {
+			continue
+		}
+		signatures, redeemScript, ok := parseMultisigUnlockingScript(vin.ScriptSig)
+		if !ok {
+			continue
+		}
+		script, err := DeserializeMultisigScript(redeemScript)
+		if err != nil {
+			log.Panic(err)
+		}
+		if len(signatures) != len(script.PubKeys) {
+			signatures = make([][]byte, len(script.PubKeys))
+		}
+
+		//和Sign一样，签的是把这个输入的解锁脚本换成所引用输出的锁定脚本以后的交易副本的哈希
+		hash := tx.signatureHash(inID, prevOut)
+		for _, wallet := range wallets.Wallets {
+			i := script.keyIndex(wallet.PublicKey)
+			if i < 0 || len(signatures[i]) != 0 {
+				continue
+			}
+			r, s, err := ecdsa.Sign(rand.Reader, &wallet.PrivateKey, hash)
+			if err != nil {
+				log.Panic(err)
+			}
+			signatures[i] = append(r.Bytes(), s.Bytes()...)
+			signed++
+		}
+		tx.Vin[inID].ScriptSig = multisigUnlockingScript(signatures, redeemScript)
+	}
+
+	return signed
+}
+
+//每个多重签名输入已有的签名数和需要的签名数
+func (tx *Transaction) MultisigStatus() []string {
+	var status []string
+	for inID, vin := range tx.Vin {
+		signatures, redeemScript, ok := parseMultisigUnlockingScript(vin.ScriptSig)
+		if !ok {
+			continue
+		}
+		script, err := DeserializeMultisigScript(redeemScript)
+		if err != nil {
+			continue
+		}
+		count := 0
+		for _, sig := range signatures {
+			if len(sig) != 0 {
+				count++
+			}
+		}
+		status = append(status, fmt.Sprintf("Input %d: %d signatures, %d required", inID, count, script.M))
+	}
+	return status
+}
+
+//把几个钱包分别签过名的同一笔交易合并起来，每个位置取有签名的那一份
+func CombineMultisig(txs []*Transaction) (*Transaction, error) {
+	combined := DeserializeTransaction(txs[0].Serialize())
+	for _, tx := range txs[1:] {
+		if !bytes.Equal(tx.ID, combined.ID) || len(tx.Vin) != len(combined.Vin) {
+			return nil, ErrMultisigMismatch
+		}
+		for inID, vin := range tx.Vin {
+			signatures, redeemScript, ok := parseMultisigUnlockingScript(vin.ScriptSig)
+			if !ok {
+				continue
+			}
+			combinedSigs, combinedRedeem, ok := parseMultisigUnlockingScript(combined.Vin[inID].ScriptSig)
+			if !ok || len(signatures) != len(combinedSigs) || !bytes.Equal(redeemScript, combinedRedeem) {
+				return nil, ErrMultisigMismatch
+			}
+			for i, sig := range signatures {
+				if len(combinedSigs[i]) == 0 {
+					combinedSigs[i] = sig
+				}
+			}
+			combined.Vin[inID].ScriptSig = multisigUnlockingScript(combinedSigs, combinedRedeem)
+		}
+	}
+	return &combined, nil
+}
+
+//用钱包给交易中的多重签名输入签名，钱包加密时要先解锁
+func (bc *Blockchain) SignMultisigTransaction(tx *Transaction, wallets *Wallets) int {
+	if wallets.IsLocked() {
+		log.Panic(ErrWalletLocked)
+	}
+
+	prevTXs := make(map[string]Transaction)
+	for _, vin := range tx.Vin {
+		prevTX, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			log.Panic(err)
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+
+	return tx.SignMultisig(wallets, prevTXs)
+}
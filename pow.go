@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"crypto/sha256"
 	"bytes"
@@ -8,21 +9,39 @@ import (
 	"math"
 	"time"
     "log"
+    "os"
+    "runtime"
     "strconv"
+    "sync"
+    "sync/atomic"
     "encoding/binary"
+    "github.com/boltdb/bolt"
 )
 
-//设置证明难度
-const targetBits = 15//没有设置太高，主要是考虑调试时的时间成本
+//创世块的难度和难度调整的规则见ChainParams，之后的区块难度会根据出块时间动态调整
+
+//难度的上下限
+const minTargetBits = 1
+const maxTargetBits = 255
 
 //定义结构体，包含区块结构体，目标难度target
 type ProofOfWork struct {
     block  *Block
     target *big.Int//目标（求得的哈希值小于上界即有效）
+    extraNonce  int//nonce空间用完并且时间戳没法更新时，加在coinbase解锁脚本后面的数
+    coinbaseSig []byte//coinbase原来的解锁脚本
 }
 
-//设置随机数变化最大范围
-const maxNonce = math.MaxInt64
+//设置随机数变化最大范围，和比特币一样是32位，搜完了就换时间戳或者extra nonce再搜一遍
+const maxNonce = math.MaxUint32
+
+//挖矿的工作线程数，默认是CPU核数，可以用环境变量MINING_WORKERS设置
+func miningWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("MINING_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
 
 //编写NewProofOfWork()方法，新建ProofOfWork结构体
 func NewProofOfWork(b *Block) *ProofOfWork {
@@ -30,28 +49,17 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
 
 	//Lsh为移位函数，将括号中的前一个数（1）左移后一个数位
-    target.Lsh(target, uint(256-targetBits))
+	//难度不再是全局常量，而是区块自己记录的Bits
+    target.Lsh(target, uint(256-b.Bits))
 
-    pow := &ProofOfWork{b, target}
+    pow := &ProofOfWork{b, target, 0, nil}
 
     return pow
 }
  
-//准备数据，将所有数据转化为切片，再进行拼接
+//准备数据，就是区块头工作量证明的数据，见BlockHeader.powData
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
-    data := bytes.Join(
-        [][]byte{
-            pow.block.PrevBlockHash,
-            pow.block.HashTransactions(),
-            //这里被修改，把之前的Data字段修改成交易字段的哈希
-            []byte(strconv.FormatInt(pow.block.Timestamp,10)),
-			[]byte(strconv.FormatInt(targetBits,10)),
-			[]byte(strconv.FormatInt(int64(nonce),10)),
-        },    
-		[]byte{},
-    )
-
-    return data
+    return pow.block.Header().powData(nonce)
 }
 
 //将一个 int64 转化为一个切片，proofofwork中准备数据时调用
@@ -66,49 +74,251 @@ func IntToHex(num int64) []byte{
 }
 
 //工作量证明寻找有效哈希
-func (pow *ProofOfWork) Run() (int, []byte) {
-    var hashInt big.Int
-    var hash [32]byte
-    nonce := 0
-    for nonce < maxNonce {
-        data := pow.prepareData(nonce)
-        hash = sha256.Sum256(data)
-        hashInt.SetBytes(hash[:])
-		
-		//比较无符号整数大小，看Hash值是否小于目标值
-        if hashInt.Cmp(pow.target) == -1 {
-            fmt.Printf("\rPow success!\nhash:%x nonce:%v", hash, nonce)
-            break
-        } else {
-            nonce++
-        }
-    }
-    fmt.Print("\n")
-    return nonce, hash[:]
+//nonce空间分给miningWorkers()个工作线程同时搜索，任何一个找到有效哈希所有线程就都停下
+//整个nonce空间都搜完了还没找到，就更新时间戳（或者extra nonce）再搜，挖矿期间每秒报告一次算力
+//ctx被取消时所有线程停下，返回取消的原因
+func (pow *ProofOfWork) Run(ctx context.Context) (int, []byte, error) {
+	workers := miningWorkers()
+	var hashes uint64
+	start := time.Now()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fmt.Printf("\rMining with %d workers: %s", workers, hashrate(atomic.LoadUint64(&hashes), time.Since(start)))
+			}
+		}
+	}()
+
+	for {
+		nonce, hash, found := pow.search(ctx, workers, maxNonce, &hashes)
+		if ctx.Err() != nil {
+			close(done)
+			<-stopped
+			summary := fmt.Sprintf("Pow aborted after %d hashes, %s", hashes, hashrate(hashes, time.Since(start)))
+			fmt.Printf("\r%-50s\n", summary)
+			return 0, nil, context.Cause(ctx)
+		}
+		if found {
+			close(done)
+			<-stopped
+			//补上空格盖住之前报告算力的那一行
+			summary := fmt.Sprintf("Pow success! %d hashes, %s", hashes, hashrate(hashes, time.Since(start)))
+			fmt.Printf("\r%-50s\nhash:%x nonce:%v\n", summary, hash, nonce)
+			return nonce, hash, nil
+		}
+		pow.nextRound()
+	}
+}
+
+//工作量证明的结果
+type powResult struct {
+	nonce int
+	hash  []byte
+}
+
+//用workers个工作线程搜索[0, limit]范围内的nonce，第i个线程依次尝试i、i+workers、i+2*workers……
+//hashes累计尝试过的哈希次数，找不到有效哈希或者ctx被取消时第三个返回值是false
+func (pow *ProofOfWork) search(ctx context.Context, workers, limit int, hashes *uint64) (int, []byte, bool) {
+	template := pow.prepareData(0)
+	result := make(chan powResult, 1)
+	var stop int32
+	var wg sync.WaitGroup
+
+	//ctx被取消时让工作线程停下
+	searched := make(chan struct{})
+	defer close(searched)
+	go func() {
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&stop, 1)
+		case <-searched:
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			var hashInt big.Int
+			data := append([]byte{}, template...)
+			count := uint64(0)
+			for nonce := first; nonce <= limit && atomic.LoadInt32(&stop) == 0; nonce += workers {
+				hash := sha256.Sum256(pow.setNonce(data, nonce))
+				hashInt.SetBytes(hash[:])
+				count++
+				//比较无符号整数大小，看Hash值是否小于目标值
+				if hashInt.Cmp(pow.target) == -1 {
+					if atomic.CompareAndSwapInt32(&stop, 0, 1) {
+						result <- powResult{nonce, hash[:]}
+					}
+					break
+				}
+				//不用每次都更新共享的计数
+				if count == 1024 {
+					atomic.AddUint64(hashes, count)
+					count = 0
+				}
+			}
+			atomic.AddUint64(hashes, count)
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case r := <-result:
+		return r.nonce, r.hash, ctx.Err() == nil
+	default:
+		return 0, nil, false
+	}
+}
+
+//把prepareData(0)得到的数据data中的nonce换掉，区块头编码中nonce后面只有8字节的高度
+//这样每次尝试不用重新编码区块头和计算Merkle根，版本0的旧区块nonce是字符串，只能重新拼接
+func (pow *ProofOfWork) setNonce(data []byte, nonce int) []byte {
+	if pow.block.Version == 0 {
+		return pow.prepareData(nonce)
+	}
+	binary.BigEndian.PutUint64(data[len(data)-16:], uint64(nonce))
+	return data
+}
+
+//nonce空间搜完了还没有找到有效哈希，换一个区块头再搜
+//时间已经过去了就更新时间戳，否则改coinbase中的extra nonce，这样Merkle根就变了
+func (pow *ProofOfWork) nextRound() {
+	now := time.Now().Unix()
+	if now > pow.block.Timestamp {
+		pow.block.Timestamp = now
+		return
+	}
+	if len(pow.block.Transactions) == 0 || !pow.block.Transactions[0].IsCoinbase() {
+		pow.block.Timestamp++
+		return
+	}
+
+	coinbase := pow.block.Transactions[0]
+	if pow.coinbaseSig == nil {
+		pow.coinbaseSig = coinbase.Vin[0].ScriptSig
+	}
+	pow.extraNonce++
+	coinbase.Vin[0].ScriptSig = append(append([]byte{}, pow.coinbaseSig...), opInt(int64(pow.extraNonce))...)
+	coinbase.ID = coinbase.Hash()
+}
+
+//算力，每秒尝试的哈希次数
+func hashrate(hashes uint64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "0 hashes/s"
+	}
+	return fmt.Sprintf("%.0f hashes/s", float64(hashes)/elapsed.Seconds())
 }
  
-//生成新块的函数，参数需要Data/交易与PrevBlockHash,返回一个指向区块结构体的指针
-func NewBlock(transactions []*Transaction, prevBlockHash []byte) *Block {
-    block := &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0}
+//生成新块的函数，参数需要Data/交易、PrevBlockHash、区块高度和难度,返回一个指向区块结构体的指针
+//ctx被取消时放弃挖矿，返回取消的原因
+func NewBlock(ctx context.Context, transactions []*Transaction, prevBlockHash []byte, height int, bits int) (*Block, error) {
+    block := newCandidateBlock(transactions, prevBlockHash, height, bits)
+    err := block.Mine(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    return block, nil
+}
+
+//还没有做工作量证明的候选区块
+func newCandidateBlock(transactions []*Transaction, prevBlockHash []byte, height int, bits int) *Block {
+    return &Block{blockVersion, time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0, height, bits}
+}
+
+//对候选区块做工作量证明，ctx被取消时放弃，返回取消的原因
+func (b *Block) Mine(ctx context.Context) error {
     //生成一个pow结构体
-	pow := NewProofOfWork(block)
+	pow := NewProofOfWork(b)
 	//工作量证明——运行计算出符合条件的nonce,hash值
-    nonce, hash := pow.Run()
+    nonce, hash, err := pow.Run(ctx)
+    if err != nil {
+        return err
+    }
 	//将结果赋值给Block结构体
-    block.Hash = hash[:]
-    block.Nonce = nonce
+    b.Hash = hash[:]
+    b.Nonce = nonce
 
-    return block
+    return nil
 }
  
 //对结果进行验证，看是否满足工作量证明难度
-func (pow *ProofOfWork) Validate() bool {
-    var hashInt big.Int
+//expectedBits是按照链的难度调整规则这个区块应该有的难度，区块自己声明的难度必须和它一致
+func (pow *ProofOfWork) Validate(expectedBits int) bool {
+    return pow.block.Header().Validate(expectedBits)
+}
+
+/*难度调整
+每隔params.RetargetInterval个区块，用这段时间内实际的出块时间和期望的出块时间比较
+1.	出块太快，就增加难度（Bits变大）
+2.	出块太慢，就降低难度（Bits变小）
+和比特币一样，一次调整最多只能变为原来的4倍或1/4，我们的难度是以位为单位的，所以一次最多调整2位
+只需要区块头，不用解码区块里的交易
+*/
+func (bc *Blockchain) CalculateNextBits(prevBlock *BlockHeader) int {
+	return nextBits(bc.db, prevBlock)
+}
+
+//按难度调整的规则算出prevBlock的下一个区块的难度，db中要有prevBlock往前的区块头，轻节点的数据库也可以
+func nextBits(db *bolt.DB, prevBlock *BlockHeader) int {
+	height := prevBlock.Height + 1
+	//不到调整的高度，沿用上一个区块的难度，有的网络难度不调整
+	if height%params.RetargetInterval != 0 || params.NoRetargeting {
+		return prevBlock.Bits
+	}
+
+	//往回找到这个调整周期的第一个区块
+	firstBlock := prevBlock
+	bci := &HeaderIterator{prevBlock.PrevBlockHash, db}
+	for i := 1; i < params.RetargetInterval; i++ {
+		_, firstBlock = bci.Next()
+	}
+
+	expectedTimespan := params.TargetSpacing * int64(params.RetargetInterval-1)
+	actualTimespan := prevBlock.Timestamp - firstBlock.Timestamp
+	//把实际时间限制在期望时间的1/4到4倍之间
+	if actualTimespan < expectedTimespan/4 {
+		actualTimespan = expectedTimespan / 4
+	}
+	if actualTimespan > expectedTimespan*4 {
+		actualTimespan = expectedTimespan * 4
+	}
+
+	//target每翻一倍难度就少一位，所以调整的位数是两个时间之比的对数
+	delta := int(math.Round(math.Log2(float64(expectedTimespan) / float64(actualTimespan))))
+	bits := prevBlock.Bits + delta
+	if bits < minTargetBits {
+		bits = minTargetBits
+	}
+	if bits > maxTargetBits {
+		bits = maxTargetBits
+	}
 
-    data := pow.prepareData(pow.block.Nonce)
-    hash := sha256.Sum256(data)
-    hashInt.SetBytes(hash[:])//变量由切片
-    isValid := hashInt.Cmp(pow.target) == -1
+	return bits
+}
+
+//根据链的规则计算某个区块应当满足的难度，创世块使用初始难度
+func (bc *Blockchain) ExpectedBits(block *Block) int {
+	if len(block.PrevBlockHash) == 0 {
+		return params.GenesisBits
+	}
 
-    return isValid
-}
\ No newline at end of file
+	prevBlock, err := bc.GetHeader(block.PrevBlockHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return bc.CalculateNextBits(prevBlock)
+}
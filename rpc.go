@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//一个HTTP请求体最多这么多字节，批量请求也算在内
+const maxRPCRequestSize = 1 << 20
+
+//没有给-rpcauth时，用户名是__cookie__，密码每次启动时随机生成，写在cookie文件里
+const rpcCookieUser = "__cookie__"
+
+//和数据库文件一样，每个节点的cookie文件用NODE_ID区分
+func rpcCookieFileName() string {
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		return dataFile("rpc.cookie")
+	}
+	return dataFile(fmt.Sprintf("rpc_%s.cookie", nodeID))
+}
+
+//JSON-RPC 2.0规定的错误码，-32000是我们自己的错误（找不到区块、余额不足等）
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+//一个JSON-RPC请求，ID为空的请求是通知，不需要回复
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+//一个JSON-RPC回复，Result和Error只有一个
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+//getbalance返回的余额，还不够成熟的coinbase输出单独列出来，和命令行的getbalance一样
+type rpcBalance struct {
+	Mature   int `json:"mature"`
+	Immature int `json:"immature"`
+}
+
+//getblock返回的区块
+type rpcBlock struct {
+	Hash          string   `json:"hash"`
+	Height        int      `json:"height"`
+	Version       int      `json:"version"`
+	PrevBlockHash string   `json:"previousblockhash"`
+	MerkleRoot    string   `json:"merkleroot"`
+	Time          int64    `json:"time"`
+	Bits          int      `json:"bits"`
+	Nonce         int      `json:"nonce"`
+	Tx            []string `json:"tx"`
+}
+
+//gettransaction返回的交易，还在交易池中的交易没有BlockHash，Confirmations为0
+type rpcTransaction struct {
+	TxID          string        `json:"txid"`
+	Version       int           `json:"version"`
+	BlockHash     string        `json:"blockhash,omitempty"`
+	Confirmations int           `json:"confirmations"`
+	LockTime      int64         `json:"locktime"`
+	Vin           []rpcTxInput  `json:"vin"`
+	Vout          []rpcTxOutput `json:"vout"`
+}
+
+type rpcTxInput struct {
+	TxID     string `json:"txid,omitempty"`
+	Vout     int    `json:"vout"`
+	Coinbase bool   `json:"coinbase,omitempty"`
+}
+
+type rpcTxOutput struct {
+	N       int    `json:"n"`
+	Value   int    `json:"value"`
+	Address string `json:"address"`
+}
+
+//RPC方法的参数，既可以按位置传（数组），也可以按名字传（对象）
+type rpcParams struct {
+	positional []json.RawMessage
+	named      map[string]json.RawMessage
+}
+
+//取出第index个、名字为name的参数，没有传时返回false
+func (p rpcParams) get(index int, name string, v interface{}) (bool, error) {
+	var raw json.RawMessage
+	if p.named != nil {
+		raw = p.named[name]
+	} else if index < len(p.positional) {
+		raw = p.positional[index]
+	}
+	if raw == nil || string(raw) == "null" {
+		return false, nil
+	}
+
+	err := json.Unmarshal(raw, v)
+	if err != nil {
+		return false, &rpcError{rpcInvalidParams, fmt.Sprintf("Invalid parameter %s: %s", name, err)}
+	}
+	return true, nil
+}
+
+//必须传的参数
+func (p rpcParams) require(index int, name string, v interface{}) error {
+	ok, err := p.get(index, name, v)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &rpcError{rpcInvalidParams, fmt.Sprintf("Missing parameter %s", name)}
+	}
+	return nil
+}
+
+//RPC服务，和节点共用同一个打开的区块链和交易池，auth为"用户名:密码"，每个请求都要带上
+type rpcServer struct {
+	bc   *Blockchain
+	auth string
+}
+
+type rpcMethod func(s *rpcServer, params rpcParams) (interface{}, error)
+
+var rpcMethods = map[string]rpcMethod{
+	"getblockcount":    rpcGetBlockCount,
+	"getblock":         rpcGetBlock,
+	"gettransaction":   rpcGetTransaction,
+	"getbalance":       rpcGetBalance,
+	"sendtoaddress":    rpcSendToAddress,
+	"listaddresses":    rpcListAddresses,
+	"getnewaddress":    rpcGetNewAddress,
+	"walletpassphrase": rpcWalletPassphrase,
+	"walletlock":       rpcWalletLock,
+}
+
+//在localhost:port上启动JSON-RPC服务，请求用HTTP POST发送
+//RPC可以动用钱包里的币，所以一定要认证：auth为空时生成一个cookie，只有能读cookie文件的人才能调用
+func startRPCServer(port, auth string, bc *Blockchain) {
+	if auth == "" {
+		var err error
+		auth, err = writeRPCCookie()
+		if err != nil {
+			fmt.Printf("JSON-RPC server not started: %s\n", err)
+			return
+		}
+		fmt.Printf("JSON-RPC credentials are written to %s\n", rpcCookieFileName())
+	}
+	server := &rpcServer{bc, auth}
+	address := fmt.Sprintf("localhost:%s", port)
+
+	fmt.Printf("JSON-RPC server listening on http://%s/\n", address)
+	err := http.ListenAndServe(address, server)
+	if err != nil {
+		fmt.Printf("JSON-RPC server stopped: %s\n", err)
+	}
+}
+
+//生成随机的密码写进cookie文件，文件只有自己可以读写，返回"用户名:密码"
+func writeRPCCookie() (string, error) {
+	password := make([]byte, 32)
+	_, err := rand.Read(password)
+	if err != nil {
+		return "", err
+	}
+
+	cookie := rpcCookieUser + ":" + hex.EncodeToString(password)
+	err = ioutil.WriteFile(rpcCookieFileName(), []byte(cookie), 0600)
+	if err != nil {
+		return "", err
+	}
+	return cookie, nil
+}
+
+//比较请求带的用户名密码，先算哈希再用固定时间比较，不会从比较的时间上泄露密码
+func (s *rpcServer) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	got := sha256.Sum256([]byte(user + ":" + password))
+	want := sha256.Sum256([]byte(s.auth))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+//只接受Content-Type为application/json的POST请求
+//浏览器跨域发送这种请求之前要先发OPTIONS预检，我们不回应预检，所以网页不能替用户调用RPC
+func (s *rpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests must be sent with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRPCRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var result interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		//批量请求，逐个处理，通知不放进回复里
+		var batch []json.RawMessage
+		if json.Unmarshal(body, &batch) != nil || len(batch) == 0 {
+			result = rpcErrorResponse(nil, rpcInvalidRequest, "Invalid request")
+		} else {
+			var responses []*rpcResponse
+			for _, raw := range batch {
+				if response := s.handle(raw); response != nil {
+					responses = append(responses, response)
+				}
+			}
+			if len(responses) > 0 {
+				result = responses
+			}
+		}
+	} else if response := s.handle(body); response != nil {
+		result = response
+	}
+
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+//处理一个请求，请求是通知时返回nil
+func (s *rpcServer) handle(raw []byte) *rpcResponse {
+	var request rpcRequest
+	if err := json.Unmarshal(raw, &request); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return rpcErrorResponse(nil, rpcParseError, "Parse error")
+		}
+		return rpcErrorResponse(nil, rpcInvalidRequest, "Invalid request")
+	}
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return rpcErrorResponse(request.ID, rpcInvalidRequest, "Invalid request")
+	}
+
+	result, err := s.call(request)
+	if request.ID == nil {
+		return nil
+	}
+	if err != nil {
+		if rpcErr, ok := err.(*rpcError); ok {
+			return rpcErrorResponse(request.ID, rpcErr.Code, rpcErr.Message)
+		}
+		return rpcErrorResponse(request.ID, rpcServerError, err.Error())
+	}
+
+	return &rpcResponse{"2.0", result, nil, request.ID}
+}
+
+//调用RPC方法，和处理节点消息一样要先拿到serverLock
+//区块链和钱包的函数出错时大多直接log.Panic，这里把panic变成错误返回，不能让一个请求把节点弄停
+func (s *rpcServer) call(request rpcRequest) (result interface{}, err error) {
+	method, ok := rpcMethods[request.Method]
+	if !ok {
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("Method %s is not found", request.Method)}
+	}
+
+	var params rpcParams
+	trimmed := bytes.TrimSpace(request.Params)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(trimmed, &params.named)
+	} else if len(trimmed) > 0 && string(trimmed) != "null" {
+		err = json.Unmarshal(trimmed, &params.positional)
+	}
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "Params must be an array or an object"}
+	}
+
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			result = nil
+			err = errors.New(strings.TrimPrefix(fmt.Sprint(r), "ERROR: "))
+		}
+	}()
+
+	return method(s, params)
+}
+
+func rpcErrorResponse(id json.RawMessage, code int, message string) *rpcResponse {
+	return &rpcResponse{"2.0", nil, &rpcError{code, message}, id}
+}
+
+//getblockcount：主链顶端区块的高度
+func rpcGetBlockCount(s *rpcServer, params rpcParams) (interface{}, error) {
+	return s.bc.GetBestHeight(), nil
+}
+
+//getblock hash：通过区块哈希查询区块
+func rpcGetBlock(s *rpcServer, params rpcParams) (interface{}, error) {
+	var hash string
+	if err := params.require(0, "hash", &hash); err != nil {
+		return nil, err
+	}
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "Invalid block hash"}
+	}
+
+	block, err := s.bc.GetBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	result := rpcBlock{
+		Hash:          hex.EncodeToString(block.Hash),
+		Height:        block.Height,
+		Version:       block.Version,
+		PrevBlockHash: hex.EncodeToString(block.PrevBlockHash),
+		MerkleRoot:    hex.EncodeToString(block.HashTransactions()),
+		Time:          block.Timestamp,
+		Bits:          block.Bits,
+		Nonce:         block.Nonce,
+		Tx:            []string{},
+	}
+	for _, tx := range block.Transactions {
+		result.Tx = append(result.Tx, hex.EncodeToString(tx.ID))
+	}
+
+	return result, nil
+}
+
+//gettransaction txid：在交易池和主链中查询交易
+func rpcGetTransaction(s *rpcServer, params rpcParams) (interface{}, error) {
+	var id string
+	if err := params.require(0, "txid", &id); err != nil {
+		return nil, err
+	}
+	txID, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "Invalid transaction id"}
+	}
+
+	if tx, ok := mempool.Get(txID); ok {
+		return newRPCTransaction(&tx, nil, 0), nil
+	}
+
+	if len(s.bc.tip) > 0 {
+		tx, block, err := s.bc.FindTransactionBlock(txID)
+		if err == nil {
+			return newRPCTransaction(&tx, block.Hash, s.bc.GetBestHeight()-block.Height+1), nil
+		}
+	}
+
+	return nil, errors.New("Transaction is not found")
+}
+
+func newRPCTransaction(tx *Transaction, blockHash []byte, confirmations int) rpcTransaction {
+	result := rpcTransaction{
+		TxID:          hex.EncodeToString(tx.ID),
+		Version:       tx.Version,
+		BlockHash:     hex.EncodeToString(blockHash),
+		Confirmations: confirmations,
+		LockTime:      tx.LockTime,
+		Vin:           []rpcTxInput{},
+		Vout:          []rpcTxOutput{},
+	}
+	for _, vin := range tx.Vin {
+		if tx.IsCoinbase() {
+			result.Vin = append(result.Vin, rpcTxInput{Vout: vin.Vout, Coinbase: true})
+			continue
+		}
+		result.Vin = append(result.Vin, rpcTxInput{TxID: hex.EncodeToString(vin.Txid), Vout: vin.Vout})
+	}
+	for i, out := range tx.Vout {
+		result.Vout = append(result.Vout, rpcTxOutput{i, out.Value, out.Address()})
+	}
+
+	return result
+}
+
+//getbalance [address]：某个地址的余额，不给地址时是钱包中所有地址的余额之和
+//分成可以花费的mature和还不能花费的immature（还不够成熟的coinbase输出和时间锁还没有解开的输出）两部分
+func rpcGetBalance(s *rpcServer, params rpcParams) (interface{}, error) {
+	var address string
+	if _, err := params.get(0, "address", &address); err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	if address != "" {
+		if !ValidateAddress(address) {
+			return nil, &rpcError{rpcInvalidParams, "Address is not valid"}
+		}
+		addresses = []string{address}
+	} else {
+		wallets, err := NewWallets()
+		if err != nil {
+			return nil, err
+		}
+		addresses = wallets.GetAddresses()
+	}
+
+	UTXOSet := UTXOSet{s.bc}
+	var balance rpcBalance
+	for _, address := range addresses {
+		mature, immature := UTXOSet.GetBalance(AddressToPubKeyHash(address))
+		balance.Mature += mature
+		balance.Immature += immature
+	}
+
+	return balance, nil
+}
+
+//sendtoaddress address amount [fee] [from]：从钱包中的地址付款，交易放进交易池并广播出去
+//不给from时用钱包中第一个余额足够的地址付款，返回交易ID
+func rpcSendToAddress(s *rpcServer, params rpcParams) (interface{}, error) {
+	var to, from string
+	var amount, fee int
+	if err := params.require(0, "address", &to); err != nil {
+		return nil, err
+	}
+	if err := params.require(1, "amount", &amount); err != nil {
+		return nil, err
+	}
+	if _, err := params.get(2, "fee", &fee); err != nil {
+		return nil, err
+	}
+	if _, err := params.get(3, "from", &from); err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(to) || (from != "" && !ValidateAddress(from)) {
+		return nil, &rpcError{rpcInvalidParams, "Address is not valid"}
+	}
+	if amount <= 0 || fee < 0 {
+		return nil, &rpcError{rpcInvalidParams, "Amount must be positive and fee can not be negative"}
+	}
+
+	wallets, err := NewWallets()
+	if err != nil {
+		return nil, err
+	}
+	if wallets.IsLocked() {
+		return nil, ErrWalletLocked
+	}
+
+	UTXOSet := UTXOSet{s.bc}
+	if from == "" {
+		for _, address := range wallets.GetAddresses() {
+			acc, _ := UTXOSet.FindSpendableOutputs(AddressToPubKeyHash(address), amount+fee, mempool)
+			if acc >= amount+fee {
+				from = address
+				break
+			}
+		}
+		if from == "" {
+			return nil, errors.New("Not enough funds")
+		}
+	} else if _, ok := wallets.Wallets[from]; !ok {
+		return nil, errors.New("Address is not in the wallet")
+	}
+
+	tx := NewUTXOTransaction(from, to, amount, fee, 0, 0, 0, &UTXOSet, mempool)
+	err = mempool.Add(tx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Transaction %x is sent by RPC\n", tx.ID)
+	broadcastInv("", "tx", [][]byte{tx.ID})
+	wakeMiner()
+
+	return hex.EncodeToString(tx.ID), nil
+}
+
+//listaddresses：钱包中的所有地址
+func rpcListAddresses(s *rpcServer, params rpcParams) (interface{}, error) {
+	wallets, err := NewWallets()
+	if err != nil {
+		return []string{}, nil
+	}
+	addresses := wallets.GetAddresses()
+	if addresses == nil {
+		addresses = []string{}
+	}
+
+	return addresses, nil
+}
+
+//getnewaddress：在钱包中创建一个新地址
+func rpcGetNewAddress(s *rpcServer, params rpcParams) (interface{}, error) {
+	wallets, _ := NewWallets()
+	if wallets.IsLocked() {
+		return nil, ErrWalletLocked
+	}
+
+	address := wallets.CreateWallet()
+	wallets.SaveToFile()
+
+	return address, nil
+}
+
+//walletpassphrase passphrase timeout：解锁加密的钱包，timeout秒内的sendtoaddress和getnewaddress可以签名
+//解出的密钥只保存在节点进程的内存里，节点退出或者过期以后钱包就又锁定了
+func rpcWalletPassphrase(s *rpcServer, params rpcParams) (interface{}, error) {
+	var passphrase string
+	var timeout int
+	if err := params.require(0, "passphrase", &passphrase); err != nil {
+		return nil, err
+	}
+	if err := params.require(1, "timeout", &timeout); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, &rpcError{rpcInvalidParams, "Timeout must be positive"}
+	}
+
+	wallets, err := NewWallets()
+	if err != nil {
+		return nil, err
+	}
+	if !wallets.IsEncrypted() {
+		return nil, ErrWalletNotEncrypted
+	}
+	err = wallets.Unlock(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	wallets.KeepUnlocked(timeout)
+
+	return fmt.Sprintf("Wallet unlocked for %d seconds", timeout), nil
+}
+
+//walletlock：立即锁定钱包
+func rpcWalletLock(s *rpcServer, params rpcParams) (interface{}, error) {
+	wallets, err := NewWallets()
+	if err != nil {
+		return nil, err
+	}
+	wallets.Lock()
+
+	return "Wallet locked", nil
+}
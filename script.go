@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*脚本
+每个输出带一个锁定脚本（ScriptPubKey），花费它的输入带一个解锁脚本（ScriptSig）。
+验证时先执行解锁脚本，把数据压到栈上，再在同一个栈上执行锁定脚本，执行完栈顶是真值就说明输出被解锁了。
+脚本是一串操作码，没有循环和跳转，执行时间只和脚本长度有关。标准的锁定脚本有：
+
+	P2PKH    OP_DUP OP_HASH160 <公钥哈希> OP_EQUALVERIFY OP_CHECKSIG        解锁：<签名> <公钥>
+	P2SH     OP_HASH160 <脚本哈希> OP_EQUAL                                解锁：... <赎回脚本>
+	多重签名  OP_m <公钥1> ... <公钥n> OP_n OP_CHECKMULTISIG（作为赎回脚本）   解锁：OP_0 <签名1> ... <签名n> <赎回脚本>
+	数据      OP_RETURN <数据>                                             不能被花费
+	时间锁    <lock> OP_CHECKLOCKTIMEVERIFY OP_DROP <P2PKH或P2SH脚本>        到了高度（或时间）lock以后按后面的脚本解锁
+	         <n> OP_CHECKSEQUENCEVERIFY OP_DROP <P2PKH或P2SH脚本>           输出被确认n个区块以后按后面的脚本解锁
+
+P2SH的锁定脚本执行成功以后，解锁脚本最后压入的赎回脚本还要在剩下的栈上再执行一次，加了时间锁的P2SH也一样。
+多重签名的解锁脚本按公钥的顺序每个公钥一个位置，还没有签名的位置是OP_0，至少要有m个有效签名。
+脚本中的数：OP_0是0，OP_1到OP_16是1到16，其他的数是最多8字节的大端无符号整数。
+*/
+
+//支持的操作码，数值和比特币一样
+const (
+	OP_0                   = 0x00
+	OP_PUSHDATA1           = 0x4c //后面1字节长度
+	OP_PUSHDATA2           = 0x4d //后面2字节大端长度
+	OP_1                   = 0x51
+	OP_16                  = 0x60
+	OP_VERIFY              = 0x69
+	OP_RETURN              = 0x6a
+	OP_DROP                = 0x75
+	OP_DUP                 = 0x76
+	OP_EQUAL               = 0x87
+	OP_EQUALVERIFY         = 0x88
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9
+	OP_CHECKSIG            = 0xac
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+var opcodeNames = map[byte]string{
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_SHA256:              "OP_SHA256",
+	OP_HASH160:             "OP_HASH160",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+//脚本的限制，防止一笔交易占用太多内存
+const (
+	maxScriptSize        = 10000
+	maxScriptElementSize = 2048
+	maxStackSize         = 1000
+)
+
+//OP_CHECKLOCKTIMEVERIFY的参数和交易的LockTime小于它时是区块高度，否则是Unix时间
+//OP_CHECKSEQUENCEVERIFY的参数只能是区块数，必须小于它
+const lockTimeThreshold = 500000000
+
+//执行脚本时的错误
+var (
+	ErrScriptParse     = errors.New("Script is truncated")
+	ErrScriptSize      = errors.New("Script or stack is too large")
+	ErrScriptOpcode    = errors.New("Script uses an unsupported opcode")
+	ErrScriptStack     = errors.New("Script needs more items on the stack")
+	ErrScriptNumber    = errors.New("Script number is out of range")
+	ErrScriptReturn    = errors.New("Script contains OP_RETURN and can not be spent")
+	ErrScriptVerify    = errors.New("Script verify failed")
+	ErrScriptFalse     = errors.New("Script finished with false on the stack")
+	ErrScriptLockTime  = errors.New("Output is locked until a later block height or time")
+	ErrScriptSigNoPush = errors.New("Unlocking script can only push data")
+	ErrScriptDummy     = errors.New("OP_CHECKMULTISIG needs an empty item below the signatures")
+)
+
+//标准锁定脚本的类型
+const (
+	scriptNonStandard = iota
+	scriptPubKeyHash
+	scriptScriptHash
+	scriptNullData
+)
+
+//脚本中的一条指令，压栈指令的data是压入的数据
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+//是否是压栈指令（不包括OP_1到OP_16）
+func (op scriptOp) isPush() bool {
+	return op.opcode <= OP_PUSHDATA2
+}
+
+//把脚本拆成一条条指令
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+	if len(script) > maxScriptSize {
+		return nil, ErrScriptSize
+	}
+
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		n := 0
+		switch {
+		case opcode < OP_PUSHDATA1:
+			n = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, ErrScriptParse
+			}
+			n = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, ErrScriptParse
+			}
+			n = int(binary.BigEndian.Uint16(script[i:]))
+			i += 2
+		default:
+			ops = append(ops, scriptOp{opcode, nil})
+			continue
+		}
+
+		if i+n > len(script) {
+			return nil, ErrScriptParse
+		}
+		ops = append(ops, scriptOp{opcode, script[i : i+n]})
+		i += n
+	}
+
+	return ops, nil
+}
+
+//压入data的指令，按能用的最短方式编码
+func opPush(data []byte) []byte {
+	n := len(data)
+	switch {
+	case n == 0:
+		return []byte{OP_0}
+	case n < OP_PUSHDATA1:
+		return append([]byte{byte(n)}, data...)
+	case n <= 0xff:
+		return append([]byte{OP_PUSHDATA1, byte(n)}, data...)
+	default:
+		return append([]byte{OP_PUSHDATA2, byte(n >> 8), byte(n)}, data...)
+	}
+}
+
+//压入数n的指令
+func opInt(n int64) []byte {
+	if n == 0 {
+		return []byte{OP_0}
+	}
+	if n >= 1 && n <= 16 {
+		return []byte{byte(OP_1 + n - 1)}
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	return opPush(bytes.TrimLeft(b[:], "\x00"))
+}
+
+//把栈上的数据当作数读出来
+func scriptNum(data []byte) (int64, error) {
+	if len(data) > 8 || (len(data) == 8 && data[0]&0x80 != 0) {
+		return 0, ErrScriptNumber
+	}
+	var n int64
+	for _, b := range data {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+//栈上的数据是否为真，空的或者全是0的数据是假
+func scriptBool(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//P2PKH锁定脚本
+func PayToPubKeyHashScript(pubKeyHash []byte) []byte {
+	return bytes.Join([][]byte{{OP_DUP, OP_HASH160}, opPush(pubKeyHash), {OP_EQUALVERIFY, OP_CHECKSIG}}, nil)
+}
+
+//P2SH锁定脚本
+func PayToScriptHashScript(scriptHash []byte) []byte {
+	return bytes.Join([][]byte{{OP_HASH160}, opPush(scriptHash), {OP_EQUAL}}, nil)
+}
+
+//OP_RETURN输出的锁定脚本，用来在链上保存一段数据
+func NullDataScript(data []byte) []byte {
+	return append([]byte{OP_RETURN}, opPush(data)...)
+}
+
+//在锁定脚本script前面加上时间锁，op是OP_CHECKLOCKTIMEVERIFY或OP_CHECKSEQUENCEVERIFY
+func TimeLockScript(op byte, lock int64, script []byte) []byte {
+	return bytes.Join([][]byte{opInt(lock), {op, OP_DROP}, script}, nil)
+}
+
+//把时间锁从锁定脚本中分出来，返回时间锁的操作码、参数和后面的脚本，没有时间锁时操作码是0
+func splitTimeLock(script []byte) (byte, int64, []byte) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 3 || ops[2].opcode != OP_DROP ||
+		(ops[1].opcode != OP_CHECKLOCKTIMEVERIFY && ops[1].opcode != OP_CHECKSEQUENCEVERIFY) {
+		return 0, 0, script
+	}
+
+	var lock int64
+	switch {
+	case ops[0].isPush():
+		if lock, err = scriptNum(ops[0].data); err != nil {
+			return 0, 0, script
+		}
+	case ops[0].opcode >= OP_1 && ops[0].opcode <= OP_16:
+		lock = int64(ops[0].opcode - OP_1 + 1)
+	default:
+		return 0, 0, script
+	}
+	//只认最短编码的参数，这样前缀的长度是确定的
+	prefix := TimeLockScript(ops[1].opcode, lock, nil)
+	if !bytes.HasPrefix(script, prefix) {
+		return 0, 0, script
+	}
+	return ops[1].opcode, lock, script[len(prefix):]
+}
+
+//高度为height、时间为blockTime的区块是否已经到了lockTime，lockTime的含义见lockTimeThreshold
+func lockTimeReached(lockTime int64, height int, blockTime int64) bool {
+	if lockTime < lockTimeThreshold {
+		return int64(height) >= lockTime
+	}
+	return blockTime >= lockTime
+}
+
+//所在区块高度为prevHeight的输出的时间锁在高度为height、时间为blockTime的区块中是否已经解开，钱包选择输出时用
+func timeLockReady(script []byte, prevHeight, height int, blockTime int64) bool {
+	switch op, lock, _ := splitTimeLock(script); op {
+	case OP_CHECKLOCKTIMEVERIFY:
+		return lockTimeReached(lock, height, blockTime)
+	case OP_CHECKSEQUENCEVERIFY:
+		return lock < lockTimeThreshold && int64(height-prevHeight) >= lock
+	}
+	return true
+}
+
+//花费P2PKH输出的解锁脚本
+func pubKeyHashUnlockingScript(signature, pubKey []byte) []byte {
+	return append(opPush(signature), opPush(pubKey)...)
+}
+
+//花费多重签名P2SH输出的解锁脚本，signatures按公钥的顺序，空的表示还没有签名
+func multisigUnlockingScript(signatures [][]byte, redeemScript []byte) []byte {
+	script := []byte{OP_0}
+	for _, sig := range signatures {
+		script = append(script, opPush(sig)...)
+	}
+	return append(script, opPush(redeemScript)...)
+}
+
+//从多重签名的解锁脚本中取出每个位置的签名和赎回脚本
+func parseMultisigUnlockingScript(script []byte) ([][]byte, []byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 3 || ops[0].opcode != OP_0 {
+		return nil, nil, false
+	}
+	var signatures [][]byte
+	for _, op := range ops {
+		if !op.isPush() {
+			return nil, nil, false
+		}
+	}
+	for _, op := range ops[1 : len(ops)-1] {
+		signatures = append(signatures, op.data)
+	}
+	return signatures, ops[len(ops)-1].data, true
+}
+
+//识别标准的锁定脚本，P2PKH和P2SH同时返回其中的哈希
+func classifyScript(script []byte) (int, []byte) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return scriptNonStandard, nil
+	}
+
+	switch {
+	case len(ops) == 5 && ops[0].opcode == OP_DUP && ops[1].opcode == OP_HASH160 && ops[2].isPush() &&
+		ops[3].opcode == OP_EQUALVERIFY && ops[4].opcode == OP_CHECKSIG:
+		return scriptPubKeyHash, ops[2].data
+	case len(ops) == 3 && ops[0].opcode == OP_HASH160 && ops[1].isPush() && ops[2].opcode == OP_EQUAL:
+		return scriptScriptHash, ops[1].data
+	case len(ops) >= 1 && ops[0].opcode == OP_RETURN:
+		return scriptNullData, nil
+	}
+	return scriptNonStandard, nil
+}
+
+//把脚本转换成能读的形式，压入的数据用十六进制表示
+func disasmScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid script %x]", script)
+	}
+
+	var words []string
+	for _, op := range ops {
+		switch {
+		case op.isPush():
+			words = append(words, hex.EncodeToString(op.data))
+		case op.opcode >= OP_1 && op.opcode <= OP_16:
+			words = append(words, fmt.Sprintf("OP_%d", op.opcode-OP_1+1))
+		case opcodeNames[op.opcode] != "":
+			words = append(words, opcodeNames[op.opcode])
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN_%02x", op.opcode))
+		}
+	}
+	if len(words) == 0 {
+		return "[]"
+	}
+	return strings.Join(words, " ")
+}
+
+//执行脚本时需要的交易信息
+//height和time是交易所在（或者将要所在）的区块的高度和时间，OP_CHECKLOCKTIMEVERIFY用它们判断输出是否已经解锁
+//prevHeight是被花费的输出所在区块的高度，OP_CHECKSEQUENCEVERIFY用它算输出被确认了多少个区块
+type scriptContext struct {
+	tx         *Transaction
+	inID       int
+	prevOut    TXOutput
+	prevHeight int
+	height     int
+	time       int64
+	sigHash    []byte
+}
+
+//签名所签的哈希，同一个输入只需要算一次
+func (ctx *scriptContext) hash() []byte {
+	if ctx.sigHash == nil {
+		ctx.sigHash = ctx.tx.signatureHash(ctx.inID, ctx.prevOut)
+	}
+	return ctx.sigHash
+}
+
+//脚本执行时的栈
+type scriptStack [][]byte
+
+func (s *scriptStack) push(data []byte) error {
+	if len(data) > maxScriptElementSize || len(*s) >= maxStackSize {
+		return ErrScriptSize
+	}
+	*s = append(*s, data)
+	return nil
+}
+
+func (s *scriptStack) pop() ([]byte, error) {
+	if len(*s) == 0 {
+		return nil, ErrScriptStack
+	}
+	data := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return data, nil
+}
+
+func (s *scriptStack) popNum() (int64, error) {
+	data, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return scriptNum(data)
+}
+
+func boolBytes(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return nil
+}
+
+//在栈上执行一段脚本
+func executeScript(script []byte, stack *scriptStack, ctx *scriptContext) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if op.isPush() {
+			if err := stack.push(op.data); err != nil {
+				return err
+			}
+			continue
+		}
+		if op.opcode >= OP_1 && op.opcode <= OP_16 {
+			if err := stack.push([]byte{op.opcode - OP_1 + 1}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch op.opcode {
+		case OP_RETURN:
+			return ErrScriptReturn
+
+		case OP_VERIFY:
+			v, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			if !scriptBool(v) {
+				return ErrScriptVerify
+			}
+
+		case OP_DROP:
+			if _, err := stack.pop(); err != nil {
+				return err
+			}
+
+		case OP_DUP:
+			if len(*stack) == 0 {
+				return ErrScriptStack
+			}
+			if err := stack.push((*stack)[len(*stack)-1]); err != nil {
+				return err
+			}
+
+		case OP_EQUAL, OP_EQUALVERIFY:
+			a, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			b, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			if op.opcode == OP_EQUALVERIFY {
+				if !bytes.Equal(a, b) {
+					return ErrScriptVerify
+				}
+				continue
+			}
+			stack.push(boolBytes(bytes.Equal(a, b)))
+
+		case OP_SHA256:
+			v, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			hash := sha256.Sum256(v)
+			stack.push(hash[:])
+
+		case OP_HASH160:
+			v, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			stack.push(HashPubKey(v))
+
+		case OP_CHECKSIG:
+			pubKey, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			signature, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			stack.push(boolBytes(verifySignature(pubKey, signature, ctx.hash())))
+
+		case OP_CHECKMULTISIG:
+			valid, err := checkMultisig(stack, ctx)
+			if err != nil {
+				return err
+			}
+			stack.push(boolBytes(valid))
+
+		case OP_CHECKLOCKTIMEVERIFY:
+			//参数留在栈上，后面一般跟着OP_DROP
+			if len(*stack) == 0 {
+				return ErrScriptStack
+			}
+			lockTime, err := scriptNum((*stack)[len(*stack)-1])
+			if err != nil {
+				return err
+			}
+			if !lockTimeReached(lockTime, ctx.height, ctx.time) {
+				return ErrScriptLockTime
+			}
+
+		case OP_CHECKSEQUENCEVERIFY:
+			//和OP_CHECKLOCKTIMEVERIFY一样参数留在栈上
+			if len(*stack) == 0 {
+				return ErrScriptStack
+			}
+			blocks, err := scriptNum((*stack)[len(*stack)-1])
+			if err != nil {
+				return err
+			}
+			if blocks >= lockTimeThreshold {
+				return ErrScriptNumber
+			}
+			if int64(ctx.height-ctx.prevHeight) < blocks {
+				return ErrScriptLockTime
+			}
+
+		default:
+			return ErrScriptOpcode
+		}
+	}
+
+	return nil
+}
+
+//OP_CHECKMULTISIG：栈上从顶往下是 n、n个公钥、m、n个签名位置、一个空的占位
+//每个不为空的位置都必须是对应公钥的有效签名，有效签名至少要有m个
+func checkMultisig(stack *scriptStack, ctx *scriptContext) (bool, error) {
+	n, err := stack.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 1 || n > maxMultisigKeys {
+		return false, ErrScriptNumber
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+	m, err := stack.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 1 || m > n {
+		return false, ErrScriptNumber
+	}
+	signatures := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if signatures[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+	dummy, err := stack.pop()
+	if err != nil {
+		return false, err
+	}
+	if len(dummy) != 0 {
+		return false, ErrScriptDummy
+	}
+
+	count := int64(0)
+	for i, sig := range signatures {
+		if len(sig) == 0 {
+			continue
+		}
+		if !verifySignature(pubKeys[i], sig, ctx.hash()) {
+			return false, nil
+		}
+		count++
+	}
+	return count >= m, nil
+}
+
+//用解锁脚本scriptSig解锁锁定脚本scriptPubKey，成功时返回nil
+func verifyScript(scriptSig, scriptPubKey []byte, ctx *scriptContext) error {
+	ops, err := parseScript(scriptSig)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if !op.isPush() {
+			return ErrScriptSigNoPush
+		}
+	}
+
+	var stack scriptStack
+	if err := executeScript(scriptSig, &stack, ctx); err != nil {
+		return err
+	}
+	//P2SH还要用执行锁定脚本之前的栈执行赎回脚本
+	p2shStack := append(scriptStack{}, stack...)
+
+	if err := executeScript(scriptPubKey, &stack, ctx); err != nil {
+		return err
+	}
+	if len(stack) == 0 || !scriptBool(stack[len(stack)-1]) {
+		return ErrScriptFalse
+	}
+
+	//时间锁后面是P2SH脚本时也要执行赎回脚本，否则只压入赎回脚本不用签名就能花费
+	_, _, script := splitTimeLock(scriptPubKey)
+	if kind, _ := classifyScript(script); kind != scriptScriptHash {
+		return nil
+	}
+	redeemScript, err := p2shStack.pop()
+	if err != nil {
+		return err
+	}
+	//版本2的交易里多重签名的赎回脚本是multisig.go中的旧格式，换成同样的脚本再执行
+	if multisig, err := decodeLegacyMultisig(redeemScript); err == nil {
+		redeemScript = multisig.script()
+	}
+	if err := executeScript(redeemScript, &p2shStack, ctx); err != nil {
+		return err
+	}
+	if len(p2shStack) == 0 || !scriptBool(p2shStack[len(p2shStack)-1]) {
+		return ErrScriptFalse
+	}
+
+	return nil
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+//节点之间通过TCP通信，每条消息由12字节的命令名加上gob编码的消息内容组成
+const protocol = "tcp"
+const nodeVersion = 6 //版本2开始区块和交易用二进制编码传输，和版本1的节点无法互通；版本3的交易带脚本，版本4的交易带LockTime，版本5的区块是版本2，之前的节点读不了；版本6的version消息带网络名和创世块哈希
+const commandLength = 12
+
+//当前节点的地址
+var nodeAddress string
+
+//已知的节点，第一个是种子节点，新节点从它开始同步
+var knownNodes = []string{}
+
+//正在从其他节点下载的区块哈希，按从低到高的顺序排列
+var blocksInTransit = [][]byte{}
+
+//矿工节点接收挖矿奖励的地址，为空时节点不挖矿
+var miningAddress string
+
+//唤醒挖矿goroutine，挖矿期间收到的多笔交易只会让它再挖一次
+var minerWakeup = make(chan struct{}, 1)
+
+//从其他节点收到、还没有被打包进区块的交易，节点的交易池只放在内存里
+var mempool *Mempool
+
+//每个连接都在自己的goroutine里处理，用这个锁保证同一时间只处理一条消息
+var serverLock sync.Mutex
+
+//getaddrtxs要扫描整条链，不拿serverLock，同一时间只做一次扫描，正在扫描时收到的请求直接丢掉
+var addrTxsScan = make(chan struct{}, 1)
+
+//告诉对方自己的节点地址
+type addr struct {
+	AddrList []string
+}
+
+//发送一个区块
+type block struct {
+	AddrFrom string
+	Block    []byte
+}
+
+//请求对方发送它拥有的所有区块哈希
+type getblocks struct {
+	AddrFrom string
+}
+
+//请求对方发送某个区块或者交易
+type getdata struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+//告诉对方自己拥有哪些区块或者交易，Type为"block"或"tx"
+type inv struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
+}
+
+//发送一笔交易
+type tx struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+//请求对方发送locator之后的主链区块头，轻节点用它同步区块头，见blockLocator
+type getheaders struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+//一批主链上的区块头，按高度从低到高，每一项是区块头的编码
+type headers struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
+//轻节点请求和这些公钥哈希有关的交易
+type getaddrtxs struct {
+	AddrFrom     string
+	PubKeyHashes [][]byte
+}
+
+//和地址有关的交易，每笔都带着Merkle包含证明
+type addrtxs struct {
+	AddrFrom     string
+	Transactions []ProvenTransaction
+}
+
+//节点连接时交换版本和区块链高度，高度低的一方向高的一方请求区块
+type verzion struct {
+	Version    int
+	BestHeight int
+	AddrFrom   string
+	Network    string //对方所在的网络，见ChainParams
+	Genesis    []byte //对方链上创世块的哈希
+}
+
+//把命令名转换成固定长度的字节数组
+func commandToBytes(command string) []byte {
+	var bytes [commandLength]byte
+
+	for i, c := range command {
+		bytes[i] = byte(c)
+	}
+
+	return bytes[:]
+}
+
+//从字节数组中解析出命令名
+func bytesToCommand(bytes []byte) string {
+	var command []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			command = append(command, b)
+		}
+	}
+
+	return fmt.Sprintf("%s", command)
+}
+
+//判断节点是否在已知节点列表中
+func nodeIsKnown(addr string) bool {
+	for _, node := range knownNodes {
+		if node == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+//把新发现的节点加入已知节点列表
+func addKnownNode(addr string) {
+	if addr != nodeAddress && !nodeIsKnown(addr) {
+		knownNodes = append(knownNodes, addr)
+	}
+}
+
+//向已知节点中除了自己和except以外的所有节点发送inv消息
+func broadcastInv(except string, kind string, items [][]byte) {
+	for _, node := range knownNodes {
+		if node != nodeAddress && node != except {
+			sendInv(node, kind, items)
+		}
+	}
+}
+
+func sendAddr(address string) {
+	nodes := addr{knownNodes}
+	nodes.AddrList = append(nodes.AddrList, nodeAddress)
+	payload := gobEncode(nodes)
+	request := append(commandToBytes("addr"), payload...)
+
+	sendData(address, request)
+}
+
+func sendBlock(addr string, b *Block) {
+	data := block{nodeAddress, b.Serialize()}
+	payload := gobEncode(data)
+	request := append(commandToBytes("block"), payload...)
+
+	sendData(addr, request)
+}
+
+func sendInv(address, kind string, items [][]byte) {
+	inventory := inv{nodeAddress, kind, items}
+	payload := gobEncode(inventory)
+	request := append(commandToBytes("inv"), payload...)
+
+	sendData(address, request)
+}
+
+func sendGetBlocks(address string) {
+	payload := gobEncode(getblocks{nodeAddress})
+	request := append(commandToBytes("getblocks"), payload...)
+
+	sendData(address, request)
+}
+
+func sendGetData(address, kind string, id []byte) {
+	payload := gobEncode(getdata{nodeAddress, kind, id})
+	request := append(commandToBytes("getdata"), payload...)
+
+	sendData(address, request)
+}
+
+func sendTx(addr string, tnx *Transaction) {
+	data := tx{nodeAddress, tnx.Serialize()}
+	payload := gobEncode(data)
+	request := append(commandToBytes("tx"), payload...)
+
+	sendData(addr, request)
+}
+
+func sendGetHeaders(address string, locator [][]byte) {
+	payload := gobEncode(getheaders{nodeAddress, locator})
+	request := append(commandToBytes("getheaders"), payload...)
+
+	sendData(address, request)
+}
+
+func sendHeaders(address string, items [][]byte) {
+	payload := gobEncode(headers{nodeAddress, items})
+	request := append(commandToBytes("headers"), payload...)
+
+	sendData(address, request)
+}
+
+func sendGetAddrTxs(address string, pubKeyHashes [][]byte) {
+	payload := gobEncode(getaddrtxs{nodeAddress, pubKeyHashes})
+	request := append(commandToBytes("getaddrtxs"), payload...)
+
+	sendData(address, request)
+}
+
+func sendAddrTxs(address string, transactions []ProvenTransaction) {
+	payload := gobEncode(addrtxs{nodeAddress, transactions})
+	request := append(commandToBytes("addrtxs"), payload...)
+
+	sendData(address, request)
+}
+
+func sendVersion(addr string, bc *Blockchain) {
+	bestHeight := bc.GetBestHeight()
+	payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress, params.Name, bc.GenesisHash()})
+
+	request := append(commandToBytes("version"), payload...)
+
+	sendData(addr, request)
+}
+
+//发送数据，连不上的节点从已知节点列表中移除
+func sendData(addr string, data []byte) {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		fmt.Printf("%s is not available\n", addr)
+		var updatedNodes []string
+
+		for _, node := range knownNodes {
+			if node != addr {
+				updatedNodes = append(updatedNodes, node)
+			}
+		}
+
+		knownNodes = updatedNodes
+
+		return
+	}
+	defer conn.Close()
+
+	//发送失败只影响这一条消息，不能让节点退出
+	_, err = io.Copy(conn, bytes.NewReader(data))
+	if err != nil {
+		fmt.Printf("Sending to %s failed: %s\n", addr, err)
+	}
+}
+
+//收到其他节点告诉我们的节点地址，加入已知节点，并向它们请求区块
+func handleAddr(request []byte, bc *Blockchain) {
+	var payload addr
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed addr message dropped: %s\n", err)
+		return
+	}
+
+	for _, node := range payload.AddrList {
+		addKnownNode(node)
+	}
+	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
+
+	for _, node := range knownNodes {
+		sendGetBlocks(node)
+	}
+}
+
+//收到一个区块，把它加入区块链，然后继续请求下一个正在下载的区块
+func handleBlock(request []byte, bc *Blockchain) {
+	var payload block
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed block message dropped: %s\n", err)
+		return
+	}
+
+	block, err := decodeBlock(payload.Block)
+	if err != nil {
+		fmt.Printf("Malformed block from %s dropped: %s\n", payload.AddrFrom, err)
+		return
+	}
+
+	fmt.Printf("Recevied a new block %x\n", block.Hash)
+
+	//不认识它的父区块，说明我们落后了不止一个区块，向对方请求它所有的区块哈希
+	if len(block.PrevBlockHash) != 0 {
+		if _, err := bc.GetBlock(block.PrevBlockHash); err != nil {
+			sendGetBlocks(payload.AddrFrom)
+			return
+		}
+	}
+
+	oldTip := bc.tip
+	err = bc.AddBlock(block)
+	if err != nil && err != ErrBlockKnown {
+		fmt.Printf("Block %x is rejected: %s\n", block.Hash, err)
+	}
+
+	//收到的区块成为了新的顶端，告诉其他节点
+	if bytes.Compare(oldTip, bc.tip) != 0 && len(blocksInTransit) == 0 {
+		broadcastInv(payload.AddrFrom, "block", [][]byte{block.Hash})
+	}
+
+	//顶端变了（包括分叉切换）以后，交易池按新的UTXO集合重新验证，被回滚的区块中的交易放回交易池
+	mempool.Sync()
+
+	if len(blocksInTransit) > 0 {
+		blockHash := blocksInTransit[0]
+		sendGetData(payload.AddrFrom, "block", blockHash)
+
+		blocksInTransit = blocksInTransit[1:]
+	}
+}
+
+//轻节点请求区块头，发给它locator之后最多maxHeadersPerMsg个主链区块头
+func handleGetHeaders(request []byte, bc *Blockchain) {
+	var payload getheaders
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed getheaders message dropped: %s\n", err)
+		return
+	}
+
+	sendHeaders(payload.AddrFrom, bc.HeadersAfter(payload.Locator, maxHeadersPerMsg))
+}
+
+//轻节点请求和它的地址有关的交易，把主链上的这些交易连同Merkle包含证明发给它
+//调用时不拿serverLock，只在读取主链和发送回复时拿一下，扫描区块期间不影响处理其他消息
+func handleGetAddrTxs(request []byte, bc *Blockchain) {
+	var payload getaddrtxs
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed getaddrtxs message dropped: %s\n", err)
+		return
+	}
+	if len(payload.PubKeyHashes) > maxAddrTxsHashes {
+		fmt.Printf("getaddrtxs message with %d addresses dropped, at most %d\n", len(payload.PubKeyHashes), maxAddrTxsHashes)
+		return
+	}
+
+	select {
+	case addrTxsScan <- struct{}{}:
+	default:
+		fmt.Println("getaddrtxs message dropped, another scan is running")
+		return
+	}
+	serverLock.Lock()
+	blockHashes := bc.GetBlockHashes()
+	serverLock.Unlock()
+	transactions := bc.FindAddressTransactions(blockHashes, payload.PubKeyHashes)
+	<-addrTxsScan
+
+	serverLock.Lock()
+	sendAddrTxs(payload.AddrFrom, transactions)
+	serverLock.Unlock()
+}
+
+//对方告诉我们它有哪些区块或交易，我们请求自己还没有的
+func handleInv(request []byte, bc *Blockchain) {
+	var payload inv
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed inv message dropped: %s\n", err)
+		return
+	}
+
+	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
+
+	if payload.Type == "block" {
+		//对方发来的哈希是从顶端到创世块排列的，反过来按从低到高的顺序下载，这样每个区块的父区块都已经存在了
+		blocksInTransit = [][]byte{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if _, err := bc.GetBlock(payload.Items[i]); err != nil {
+				blocksInTransit = append(blocksInTransit, payload.Items[i])
+			}
+		}
+
+		if len(blocksInTransit) > 0 {
+			blockHash := blocksInTransit[0]
+			sendGetData(payload.AddrFrom, "block", blockHash)
+
+			blocksInTransit = blocksInTransit[1:]
+		}
+	}
+
+	if payload.Type == "tx" {
+		for _, txID := range payload.Items {
+			if !mempool.Has(txID) {
+				sendGetData(payload.AddrFrom, "tx", txID)
+			}
+		}
+	}
+}
+
+//对方请求我们所有的区块哈希
+func handleGetBlocks(request []byte, bc *Blockchain) {
+	var payload getblocks
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed getblocks message dropped: %s\n", err)
+		return
+	}
+
+	blocks := bc.GetBlockHashes()
+	sendInv(payload.AddrFrom, "block", blocks)
+}
+
+//对方请求某个区块或交易的具体内容
+func handleGetData(request []byte, bc *Blockchain) {
+	var payload getdata
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed getdata message dropped: %s\n", err)
+		return
+	}
+
+	if payload.Type == "block" {
+		block, err := bc.GetBlock(payload.ID)
+		if err != nil {
+			return
+		}
+
+		sendBlock(payload.AddrFrom, &block)
+	}
+
+	if payload.Type == "tx" {
+		tx, ok := mempool.Get(payload.ID)
+		if !ok {
+			return
+		}
+
+		sendTx(payload.AddrFrom, &tx)
+	}
+}
+
+//收到一笔交易，验证以后放进交易池，再转发给其他节点
+//矿工节点还会唤醒挖矿goroutine，把交易池中的交易打包挖出一个新区块
+func handleTx(request []byte, bc *Blockchain) {
+	var payload tx
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed tx message dropped: %s\n", err)
+		return
+	}
+
+	tx, err := decodeTransaction(payload.Transaction)
+	if err != nil {
+		fmt.Printf("Malformed transaction from %s dropped: %s\n", payload.AddrFrom, err)
+		return
+	}
+	txID := hex.EncodeToString(tx.ID)
+
+	err = mempool.Add(tx)
+	if err != nil {
+		fmt.Printf("Transaction %s dropped: %s\n", txID, err)
+		return
+	}
+	fmt.Printf("Recevied transaction %s\n", txID)
+
+	broadcastInv(payload.AddrFrom, "tx", [][]byte{tx.ID})
+	wakeMiner()
+}
+
+//唤醒挖矿goroutine，不是矿工节点时什么也不做
+func wakeMiner() {
+	if miningAddress == "" {
+		return
+	}
+	select {
+	case minerWakeup <- struct{}{}:
+	default:
+	}
+}
+
+//矿工节点的挖矿goroutine，每次被唤醒就把交易池中的交易打包挖出一个新区块，并告诉其他节点
+//ctx被取消（Ctrl-C）时放弃正在挖的区块并退出
+func runMiner(ctx context.Context, bc *Blockchain) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-minerWakeup:
+		}
+
+		newBlock, err := mineOnNode(ctx, bc)
+		if err != nil {
+			fmt.Printf("Mining aborted: %s\n", err)
+			continue
+		}
+		fmt.Printf("New block %x is mined!\n", newBlock.Hash)
+
+		serverLock.Lock()
+		broadcastInv("", "block", [][]byte{newBlock.Hash})
+		serverLock.Unlock()
+	}
+}
+
+//做工作量证明时不拿serverLock，这样挖矿期间还能处理其他节点发来的区块
+//收到的区块成为新的顶端时，正在挖的区块就过时了，放弃它，在新的顶端上重新组装区块再挖
+func mineOnNode(ctx context.Context, bc *Blockchain) (*Block, error) {
+	for {
+		serverLock.Lock()
+		tipChanged := bc.TipChanged()
+		candidate := bc.NewCandidateBlock(mempool.NewCandidateTransactions(miningAddress))
+		serverLock.Unlock()
+
+		err := candidate.MineOnTip(ctx, tipChanged)
+		if err == nil {
+			serverLock.Lock()
+			err = bc.SubmitBlock(candidate)
+			if err == nil {
+				mempool.Sync()
+			}
+			serverLock.Unlock()
+		}
+		if err == ErrTipChanged {
+			fmt.Printf("Mining aborted: %s, rebuilding block on the new tip\n", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return candidate, nil
+	}
+}
+
+//对方的区块链比我们的长就请求区块，比我们的短就把自己的版本发回去让对方来请求
+func handleVersion(request []byte, bc *Blockchain) {
+	var payload verzion
+	if err := gobDecode(request, &payload); err != nil {
+		fmt.Printf("Malformed version message dropped: %s\n", err)
+		return
+	}
+
+	if payload.Version != nodeVersion {
+		fmt.Printf("Node %s uses version %d, ignore it\n", payload.AddrFrom, payload.Version)
+		return
+	}
+	//不同网络或者不同创世块的节点，区块链没有关系，不和它通信
+	if payload.Network != params.Name || !bytes.Equal(payload.Genesis, bc.GenesisHash()) {
+		fmt.Printf("Node %s is on network %s with genesis block %x, ignore it\n", payload.AddrFrom, payload.Network, payload.Genesis)
+		return
+	}
+
+	myBestHeight := bc.GetBestHeight()
+	foreignerBestHeight := payload.BestHeight
+
+	if myBestHeight < foreignerBestHeight {
+		sendGetBlocks(payload.AddrFrom)
+	} else if myBestHeight > foreignerBestHeight {
+		sendVersion(payload.AddrFrom, bc)
+	}
+
+	//新节点第一次连上来时，把我们知道的节点告诉它
+	if !nodeIsKnown(payload.AddrFrom) {
+		addKnownNode(payload.AddrFrom)
+		sendAddr(payload.AddrFrom)
+	}
+}
+
+//读取一个连接发来的完整消息，根据命令名分发给对应的处理函数
+func handleConnection(conn net.Conn, bc *Blockchain) {
+	request, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		fmt.Printf("Reading from %s failed: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	if len(request) < commandLength {
+		return
+	}
+
+	command := bytesToCommand(request[:commandLength])
+	fmt.Printf("Received %s command\n", command)
+
+	if command == "getaddrtxs" {
+		handleGetAddrTxs(request, bc)
+		return
+	}
+
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
+	switch command {
+	case "addr":
+		handleAddr(request, bc)
+	case "block":
+		handleBlock(request, bc)
+	case "inv":
+		handleInv(request, bc)
+	case "getblocks":
+		handleGetBlocks(request, bc)
+	case "getdata":
+		handleGetData(request, bc)
+	case "getheaders":
+		handleGetHeaders(request, bc)
+	case "tx":
+		handleTx(request, bc)
+	case "version":
+		handleVersion(request, bc)
+	default:
+		fmt.Println("Unknown command!")
+	}
+}
+
+//启动节点：在port端口监听，如果给了种子节点就先向它发送版本消息开始同步
+//rpcPort不为空时同时在这个端口启动JSON-RPC服务，rpcAuth是它的"用户名:密码"，为空时用cookie文件认证
+func StartServer(port, seedAddress, minerAddress, rpcPort, rpcAuth string) {
+	nodeAddress = fmt.Sprintf("localhost:%s", port)
+	miningAddress = minerAddress
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer ln.Close()
+
+	bc := LoadBlockchain()
+	defer bc.Db().Close()
+	mempool = NewMempool(bc, false)
+
+	//Ctrl-C退出时先停止挖矿，等正在处理的消息处理完，再关闭数据库
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	minerStopped := make(chan struct{})
+	go func() {
+		defer close(minerStopped)
+		if miningAddress != "" {
+			runMiner(ctx, bc)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		<-minerStopped
+		addrTxsScan <- struct{}{}
+		serverLock.Lock()
+		bc.Db().Close()
+		os.Remove(rpcCookieFileName())
+		fmt.Println("Node stopped")
+		os.Exit(0)
+	}()
+
+	if rpcPort != "" {
+		go startRPCServer(rpcPort, rpcAuth, bc)
+	}
+
+	if seedAddress != "" && seedAddress != nodeAddress {
+		knownNodes = append(knownNodes, seedAddress)
+		sendVersion(seedAddress, bc)
+	}
+	fmt.Printf("Node %s started, best height %d\n", nodeAddress, bc.GetBestHeight())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Panic(err)
+		}
+		go handleConnection(conn, bc)
+	}
+}
+
+//解码消息内容，其他节点发来的数据不能信任，解码失败时返回错误，处理函数丢掉这条消息
+func gobDecode(request []byte, payload interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(payload)
+}
+
+//把消息内容gob编码
+func gobEncode(data interface{}) []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+//轻节点的数据库文件，只保存区块头
+const spvDBFile = "spv.db"
+
+//轻节点保存顶端区块哈希的桶，区块头、区块索引和高度索引的桶和全节点一样
+const spvBucket = "spv"
+
+//一条headers消息最多带多少个区块头，轻节点收到这么多个就接着请求
+const maxHeadersPerMsg = 2000
+
+//一条getaddrtxs消息最多带多少个公钥哈希，全节点丢掉超过的请求
+const maxAddrTxsHashes = 100
+
+//轻节点等待全节点回复的时间
+const spvTimeout = 30 * time.Second
+
+//轻节点出错的原因
+var (
+	ErrSPVTimeout     = errors.New("Full node did not reply in time")
+	ErrSPVBadMessage  = errors.New("Full node sent a malformed message")
+	ErrBadMerkleProof = errors.New("Transaction is not proven to be in a block of the verified header chain")
+)
+
+//和全节点一样，每个轻节点的数据库文件用NODE_ID区分
+func spvDBFileName() string {
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		return dataFile(spvDBFile)
+	}
+	return dataFile(fmt.Sprintf("spv_%s.db", nodeID))
+}
+
+/*轻节点（SPV，简单支付验证），给不想保存整个blockchain.db的小机器用
+1.	只从全节点同步区块头，自己检查每个区块头的难度和工作量证明，累计工作量最大的那条区块头链就是主链
+2.	查询余额时向全节点请求和地址有关的交易，每笔交易都带着Merkle包含证明，证明它在主链的某个区块里
+全节点可以少给交易，但给不出不在链上的交易
+*/
+type SPVClient struct {
+	tip      []byte
+	db       *bolt.DB
+	node     string //提供区块头和交易的全节点
+	listener net.Listener
+	messages chan []byte //全节点的回复会连到我们监听的端口上，收到的消息放在这里
+}
+
+//轻节点验证过的一笔交易，Height是它所在区块的高度
+type spvTransaction struct {
+	Tx     Transaction
+	Height int
+}
+
+//打开轻节点的数据库，在port端口监听全节点的回复，node是提供数据的全节点
+func NewSPVClient(port, node string) *SPVClient {
+	nodeAddress = fmt.Sprintf("localhost:%s", port)
+
+	db, err := bolt.Open(spvDBFileName(), 0600, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var tip []byte
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{headersBucket, blockIndexBucket, heightBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(spvBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		tip = append([]byte{}, b.Get([]byte("l"))...)
+		if len(tip) == 0 {
+			tip = nil
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c := &SPVClient{tip, db, node, ln, make(chan []byte, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			request, err := ioutil.ReadAll(conn)
+			conn.Close()
+			if err == nil && len(request) >= commandLength {
+				c.messages <- request
+			}
+		}
+	}()
+
+	return c
+}
+
+//停止监听并关闭数据库
+func (c *SPVClient) Close() {
+	c.listener.Close()
+	c.db.Close()
+}
+
+//验证过的区块头链的高度，还没有区块头时是-1
+func (c *SPVClient) BestHeight() int {
+	if c.tip == nil {
+		return -1
+	}
+
+	height := 0
+	err := c.db.View(func(tx *bolt.Tx) error {
+		height = getHeader(tx, c.tip).Height
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return height
+}
+
+//等待全节点发来一条command消息，返回去掉命令名以后的内容，其他消息都忽略
+func (c *SPVClient) wait(command string) ([]byte, error) {
+	timeout := time.After(spvTimeout)
+	for {
+		select {
+		case request := <-c.messages:
+			if bytesToCommand(request[:commandLength]) == command {
+				return request[commandLength:], nil
+			}
+		case <-timeout:
+			return nil, ErrSPVTimeout
+		}
+	}
+}
+
+//从全节点同步区块头，返回新增的区块头个数
+//某个区块头没有通过验证时停止同步，返回验证错误，之前验证过的区块头都已经保存了
+func (c *SPVClient) SyncHeaders() (int, error) {
+	added := 0
+
+	for {
+		var locator [][]byte
+		if c.tip != nil {
+			locator = blockLocator(c.db, c.BestHeight())
+		}
+		sendGetHeaders(c.node, locator)
+
+		data, err := c.wait("headers")
+		if err != nil {
+			return added, err
+		}
+		var payload headers
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&payload)
+		if err != nil {
+			return added, fmt.Errorf("%s: %s", ErrSPVBadMessage, err)
+		}
+
+		count := 0
+		for _, headerData := range payload.Headers {
+			header, err := decodeHeader(headerData)
+			if err != nil {
+				return added, fmt.Errorf("%s: %s", ErrSPVBadMessage, err)
+			}
+			isNew, err := c.addHeader(header)
+			if err != nil {
+				return added, err
+			}
+			if isNew {
+				count++
+			}
+		}
+		added += count
+
+		//全节点没有更多的区块头了
+		if len(payload.Headers) < maxHeadersPerMsg || count == 0 {
+			return added, nil
+		}
+	}
+}
+
+//验证并保存一个区块头，累计工作量超过当前顶端时成为新的顶端，已经有这个区块头时返回false
+func (c *SPVClient) addHeader(header *BlockHeader) (bool, error) {
+	hash := header.Hash()
+
+	var known bool
+	var parent *BlockHeader
+	err := c.db.View(func(tx *bolt.Tx) error {
+		known = getHeader(tx, hash) != nil
+		if len(header.PrevBlockHash) != 0 {
+			parent = getHeader(tx, header.PrevBlockHash)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if known {
+		return false, nil
+	}
+
+	if len(header.PrevBlockHash) == 0 {
+		//只接受这个网络固定的创世块，全节点发来别的创世块说明它和我们不在同一条链上
+		if c.tip != nil || !bytes.Equal(hash, params.GenesisHashBytes()) {
+			return false, &BlockValidationError{hash, ErrBadGenesis, ""}
+		}
+	} else if parent == nil {
+		return false, ErrOrphanBlock
+	}
+	err = checkHeader(c.db, hash, header, parent)
+	if err != nil {
+		return false, err
+	}
+
+	newTip := false
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		putHeader(tx, hash, header)
+		entry := getBlockIndex(tx, hash)
+		if c.tip != nil {
+			tipEntry := getBlockIndex(tx, c.tip)
+			newWork := new(big.Int).SetBytes(entry.ChainWork)
+			tipWork := new(big.Int).SetBytes(tipEntry.ChainWork)
+			if newWork.Cmp(tipWork) <= 0 {
+				return nil
+			}
+		}
+
+		updateHeightIndex(tx, hash)
+		newTip = true
+		return tx.Bucket([]byte(spvBucket)).Put([]byte("l"), hash)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if newTip {
+		c.tip = hash
+	}
+
+	return true, nil
+}
+
+//向全节点请求和这些公钥哈希有关的交易，用Merkle包含证明确认每笔交易都在验证过的区块头链的主链上
+func (c *SPVClient) FetchTransactions(pubKeyHashes [][]byte) ([]spvTransaction, error) {
+	if len(pubKeyHashes) > maxAddrTxsHashes {
+		return nil, fmt.Errorf("Too many addresses: %d, at most %d in one request", len(pubKeyHashes), maxAddrTxsHashes)
+	}
+	sendGetAddrTxs(c.node, pubKeyHashes)
+
+	data, err := c.wait("addrtxs")
+	if err != nil {
+		return nil, err
+	}
+	var payload addrtxs
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrSPVBadMessage, err)
+	}
+
+	var result []spvTransaction
+	seen := make(map[string]bool)
+	for _, proven := range payload.Transactions {
+		decoded, err := decodeTransaction(proven.Transaction)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrSPVBadMessage, err)
+		}
+		tx := *decoded
+		//同一笔交易只算一次，全节点重复发送同一笔交易不能让余额变多
+		if seen[string(tx.ID)] {
+			continue
+		}
+
+		var header *BlockHeader
+		err = c.db.View(func(dbtx *bolt.Tx) error {
+			header = getHeader(dbtx, proven.BlockHash)
+			//分支上的区块不算
+			if header != nil && !bytes.Equal(dbtx.Bucket([]byte(heightBucket)).Get(heightKey(header.Height)), proven.BlockHash) {
+				header = nil
+			}
+			return nil
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if header == nil || !proven.Proof.Verify(header.MerkleRoot, &tx) {
+			return nil, fmt.Errorf("%s: %x", ErrBadMerkleProof, tx.ID)
+		}
+		seen[string(tx.ID)] = true
+		result = append(result, spvTransaction{tx, header.Height})
+	}
+
+	return result, nil
+}
+
+//用验证过的交易算出公钥哈希的余额，和UTXOSet.GetBalance一样分成能花费的和还不能花费的两部分
+func (c *SPVClient) GetBalance(pubKeyHash []byte, transactions []spvTransaction) (int, int) {
+	mature, immature := 0, 0
+	height := c.BestHeight() + 1
+	now := time.Now().Unix()
+
+	spent := make(map[string]bool)
+	for _, stx := range transactions {
+		if stx.Tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range stx.Tx.Vin {
+			spent[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)] = true
+		}
+	}
+
+	for _, stx := range transactions {
+		outs := TXOutputs{nil, stx.Height, stx.Tx.IsCoinbase()}
+		for outIdx, out := range stx.Tx.Vout {
+			if !out.IsLockedWithKey(pubKeyHash) || spent[fmt.Sprintf("%x:%d", stx.Tx.ID, outIdx)] {
+				continue
+			}
+			if outs.IsMature(height) && timeLockReady(out.ScriptPubKey, outs.Height, height, now) {
+				mature += out.Value
+			} else {
+				immature += out.Value
+			}
+		}
+	}
+
+	return mature, immature
+}
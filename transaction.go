@@ -20,16 +20,54 @@ import (
 //coinbase交易是一种特殊的交易，它不需要引用之前一笔交易的输出
 //它“凭空”产生了币，这也是矿工获得挖出新块的奖励，可以理解为“发行新币”
 
-const subsidy = 50  //挖矿奖励
+//挖矿奖励、减半间隔和总量上限见ChainParams
+
+//coinbase交易的输出要等到所在区块后面又挖出params.CoinbaseMaturity个区块以后才能花费
+//分叉切换时被换掉的区块中的coinbase就作废了，花费它的交易也跟着作废，所以要等它足够深了才能花费
+//创世块不会被换掉，它的coinbase不受限制
+
+//不考虑总量上限时，高度在[0,height)之间的区块总共发行的币
+func scheduledIssuance(height int) int {
+	issued := 0
+	for era := 0; era*params.HalvingInterval < height && era < 63; era++ {
+		blocks := height - era*params.HalvingInterval
+		if blocks > params.HalvingInterval {
+			blocks = params.HalvingInterval
+		}
+		issued += blocks * (params.Subsidy >> uint(era))
+	}
+	return issued
+}
+
+//高度在[0,height]之间的所有区块总共发行的币，不会超过params.MaxSupply
+func SupplyAtHeight(height int) int {
+	if height < 0 {
+		return 0
+	}
+	supply := scheduledIssuance(height + 1)
+	if supply > params.MaxSupply {
+		supply = params.MaxSupply
+	}
+	return supply
+}
+
+//高度为height的区块的挖矿奖励：每params.HalvingInterval个区块减半，并且发行总量不能超过params.MaxSupply
+func BlockSubsidy(height int) int {
+	return SupplyAtHeight(height) - SupplyAtHeight(height-1)
+}
 
 //创建一个交易的数据结构，交易是由交易ID、交易输入、交易输出组成的,
 //一个交易有多个输入和多个输出，所以这里的交易输入和输出应该是切片类型的
 type Transaction struct {
+    Version int//交易的编码版本，见encoding.go，gob编码时期的旧交易是0
     ID   []byte
     Vin  []TXInput	
 		//输出里面存储了“币”
 		//存储，指的是用一个数学难题对输出进行锁定
     Vout []TXOutput
+    LockTime int64
+		//交易的锁定时间，为0时没有锁定，小于lockTimeThreshold时是区块高度，否则是Unix时间
+		//交易只能被放进高度（或者时间）不小于LockTime的区块，见IsFinal
 }
 
 //1.	有一些输出并没有被关联到某个输入上
@@ -43,11 +81,57 @@ type TXOutput struct {
 		//币，value字段存储的是satoshi的数量
 		//一个satoshi等于一百万分之一的BTC(0.00000001 BTC)
 		//这也是比特币里面最小的货币单位
-	PubkeyHash []byte
-	//ScriptPubKey string	
-		//对输出进行锁定
-		//ScriptPubKey将会存储用户定义的钱包地址
+	ScriptPubKey []byte	
+		//对输出进行锁定的脚本，见script.go
+		//付给地址时是P2PKH脚本，付给多重签名地址时是P2SH脚本
+}
+//一笔交易中还未被花费的输出的集合，存放在UTXO集合里
+//键是输出在原交易Vout中的索引，因为部分输出被花费后剩下的输出索引不再连续
+//Height是这笔交易所在区块的高度，检查相对时间锁和coinbase是否成熟时要用，Coinbase表示这是coinbase交易的输出
+type TXOutputs struct {
+	Outputs  map[int]TXOutput
+	Height   int
+	Coinbase bool
 }
+
+//这些输出能否被高度为height的区块中的交易花费，只有还不够成熟的coinbase输出不能
+func (outs TXOutputs) IsMature(height int) bool {
+	return !outs.Coinbase || height-outs.Height >= params.CoinbaseMaturity
+}
+
+//序列化TXOutputs
+func (outs TXOutputs) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(outs)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+//反序列化TXOutputs，版本3之前保存的输出换成脚本，见storedOutput
+func DeserializeOutputs(data []byte) TXOutputs {
+	var stored struct {
+		Outputs  map[int]storedOutput
+		Height   int
+		Coinbase bool
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&stored)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	outputs := TXOutputs{make(map[int]TXOutput), stored.Height, stored.Coinbase}
+	for outIdx, out := range stored.Outputs {
+		outputs.Outputs[outIdx] = out.output()
+	}
+	return outputs
+}
+
 //关于输出，非常重要的一点是：它们是不可再分的
 //要么不用，如果要用，必须一次性用完
 //如果它的值比需要的值大，那么就会产生一个找零，找零会返还给发送方
@@ -60,15 +144,12 @@ type TXInput struct {
     Vout      int
 		//存储的是该输出在这笔交易中所有输出的索引
 		//因为一笔交易可能有多个输出，需要有信息指明是具体的哪一个
-    Signature []byte
-    PubKey    []byte
-	//ScriptSig string
+	ScriptSig []byte
 		//一个脚本，提供了可作用于一个输出的 ScriptPubKey 的数据
 		//如果 ScriptSig 提供的数据是正确的，那么输出就会被解锁，然后被解锁的值就可以被用于产生新的输出
 		//如果数据不正确，输出就无法被引用在输入中，或者说，也就是无法使用这个输出
 		//这种机制，保证了用户无法花费属于其他人的币
-
-		//由于我们还没有实现地址，所以ScriptSig将仅仅存储一个任意用户定义的钱包地址
+		//花费P2PKH输出时ScriptSig是 <签名> <公钥>；coinbase交易的ScriptSig是任意数据
 }
 
 //输出，就是 “币” 存储的地方
@@ -77,25 +158,30 @@ type TXInput struct {
 //一个输入引用了之前一笔交易的输出，并提供了数据（也就是 ScriptSig 字段）
 //该数据会被用在输出的解锁脚本中解锁输出，解锁完成后即可使用它的值去产生新的输出
 
-//创建一个coinbase交易
-func NewCoinbaseTX(to, data string) *Transaction {
+//创建一个coinbase交易，矿工除了高度为height的区块的挖矿奖励，还能领取区块中所有交易的手续费fees
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction {
     if data == "" {
-        data = fmt.Sprintf("Reward to '%s'", to)
+		//加上随机数据，否则给同一个地址的两个coinbase交易内容完全一样，交易ID也就一样了
+		randData := make([]byte, 20)
+		_, err := rand.Read(randData)
+		if err != nil {
+			log.Panic(err)
+		}
+        data = fmt.Sprintf("Reward to '%s' %x", to, randData)
     }
 	//to代表此输出奖励给谁，一般都是矿工地址，data是交易附带的信息
 	
 	//fmt.Println(to)
-	txin := TXInput{[]byte{},-1,nil,[]byte(data)}
+	txin := TXInput{[]byte{},-1,opPush([]byte(data))}
     //txin := TXInput{[]byte{}, -1, data}
 		//此交易中的交易输入,没有交易输入信息
 		//Txid为空，Vout等于-1
-	txout := NewTXOutput(subsidy,to)
+	txout := NewTXOutput(BlockSubsidy(height)+fees,to)
     //txout := TXOutput{subsidy, to}
-		//交易输出,subsidy为奖励矿工的币的数量
-		//比特币中区块总数除以210000就是subsidy
+		//交易输出,BlockSubsidy(height)为奖励矿工的币的数量
 		//挖出创世块的奖励是50BTC，每挖出210000个块后，奖励减半
-		//在这里我们直接定义为一个常量
-    tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
+		//我们按比例缩小，每params.HalvingInterval个块奖励减半
+    tx := Transaction{txVersion, nil, []TXInput{txin}, []TXOutput{*txout}, 0}
     //tx.SetID()
 	tx.ID = tx.Hash()
     return &tx
@@ -115,19 +201,40 @@ func (tx *Transaction) SetID() {
 	tx.ID =  hash[:]
 }*/
 
-//返回一个序列化后的交易
+//返回一个序列化后的交易，格式见encoding.go
 func (tx Transaction) Serialize() []byte {
-	//var hash [32]byte
-	var encoder bytes.Buffer
- 
-	enc := gob.NewEncoder(&encoder)
-	err := enc.Encode(tx)
+	e := &encoder{}
+	e.transaction(&tx)
+	return e.buf.Bytes()
+}
+
+//反序列化一笔交易
+func DeserializeTransaction(data []byte) Transaction {
+	transaction, err := decodeTransaction(data)
 	if err != nil {
 		log.Panic(err)
 	}
-	//hash = sha256.Sum256(encoder.Bytes())
-	//tx.ID =  hash[:]
-	return encoder.Bytes()
+
+	return *transaction
+}
+
+//解码一笔交易，数据不完整或有多余的数据时返回错误
+func decodeTransaction(data []byte) (*Transaction, error) {
+	d := &decoder{data: data}
+	transaction := d.transaction()
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
+}
+
+//计算交易ID和Merkle叶子用的数据，版本0的旧交易仍然用当时的gob编码
+func (tx Transaction) hashData() []byte {
+	if tx.Version == 0 {
+		return tx.legacyData()
+	}
+	return tx.Serialize()
 }
 
 //返回交易的哈希值
@@ -137,11 +244,35 @@ func (tx *Transaction) Hash() []byte {
 	txCopy := *tx
 	txCopy.ID = []byte{}
  
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash = sha256.Sum256(txCopy.hashData())
  
 	return hash[:]
 }
 
+//按规则算出交易应有的ID，交易ID是在签名之前算出来的，所以计算时要去掉签名
+//1.	版本3以上：所有输入的ScriptSig置空以后的Hash()
+//2.	版本3之前：输入只去掉签名，公钥保留，因为那时的输入在签名之前就已经带着公钥了
+//coinbase没有签名，它的ScriptSig是附带的数据，ID就是Hash()
+func (tx *Transaction) ComputeID() []byte {
+	if tx.IsCoinbase() {
+		return tx.Hash()
+	}
+
+	unsigned := *tx
+	unsigned.Vin = nil
+	for _, vin := range tx.Vin {
+		if tx.Version < 3 {
+			_, pubKey, _, _ := legacyInputFields(vin.ScriptSig)
+			vin.ScriptSig, _ = legacyUnlockingScript(nil, pubKey, nil)
+		} else {
+			vin.ScriptSig = nil
+		}
+		unsigned.Vin = append(unsigned.Vin, vin)
+	}
+
+	return unsigned.Hash()
+}
+
 //1、每一个区块至少存储一笔coinbase交易，所以我们在区块的字段中把Data字段换成交易。
 //2、把所有涉及之前Data字段都要换了，比如NewBlock()、GenesisBlock()、pow里的函数
 
@@ -164,25 +295,45 @@ func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
-//方法检查输入是否使用了指定密钥来解锁一个输出
-func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := HashPubKey(in.PubKey)
- 
-	return bytes.Compare(lockingHash,pubKeyHash) == 0
-}
-
 //锁定交易输出到固定的地址，代表该输出只能由指定的地址引用
+//普通地址用P2PKH脚本锁定到公钥哈希，多重签名地址用P2SH脚本锁定到多重签名脚本的哈希
 func (out *TXOutput) Lock(address []byte) {
 	
 	pubKeyHash := Base58Decode(address)
 	//fmt.Println(address)
+	addressVersion := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1:len(pubKeyHash)-4]
-	out.PubkeyHash = pubKeyHash 
+	if addressVersion == params.ScriptHashAddrID {
+		out.ScriptPubKey = PayToScriptHashScript(pubKeyHash)
+	} else {
+		out.ScriptPubKey = PayToPubKeyHashScript(pubKeyHash)
+	}
+}
+
+//标准锁定脚本中的公钥哈希（P2SH是脚本哈希），其他脚本返回nil
+//加了时间锁的输出按时间锁后面的脚本判断
+func (out *TXOutput) PubKeyHash() []byte {
+	_, _, script := splitTimeLock(out.ScriptPubKey)
+	_, hash := classifyScript(script)
+	return hash
+}
+
+//输出锁定到的地址，不是付给地址的输出返回空字符串
+func (out *TXOutput) Address() string {
+	_, _, script := splitTimeLock(out.ScriptPubKey)
+	switch kind, hash := classifyScript(script); kind {
+	case scriptPubKeyHash:
+		return PubKeyHashToAddress(hash)
+	case scriptScriptHash:
+		return hashToAddress(params.ScriptHashAddrID, hash)
+	}
+	return ""
 }
 
 //判断输入的公钥"哈希"能否解锁该交易输出
 func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubkeyHash,pubKeyHash) == 0
+	hash := out.PubKeyHash()
+	return hash != nil && bytes.Compare(hash,pubKeyHash) == 0
 }
 
 //创建一个新的交易输出
@@ -193,6 +344,17 @@ func NewTXOutput(value int,address string) *TXOutput {
 	return txo
 }
 
+//给输出加上时间锁：op是OP_CHECKLOCKTIMEVERIFY时lock是绝对的区块高度或时间，
+//是OP_CHECKSEQUENCEVERIFY时lock是输出被确认以后还要经过的区块数
+func (out *TXOutput) LockUntil(op byte, lock int64) {
+	out.ScriptPubKey = TimeLockScript(op, lock, out.ScriptPubKey)
+}
+
+//交易能否被放进高度为height、时间为blockTime的区块
+func (tx *Transaction) IsFinal(height int, blockTime int64) bool {
+	return tx.LockTime == 0 || lockTimeReached(tx.LockTime, height, blockTime)
+}
+
 //对交易签名
 //接受一个私钥和一个之前交易的 map
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey,prevTXs map[string]Transaction) {
@@ -209,54 +371,59 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey,prevTXs map[string]Transact
 			log.Panic("ERROR: Previous transaction is not correct")
 		}
 	}
-	//将会被签署的是修剪后的交易副本，而不是一个完整交易
-	//这个副本包含了所有的输入和输出，但是TXInput.Signature和TXIput.PubKey被设置为nil
-	txCopy := tx.TrimmedCopy()
-	//迭代副本中每一个输入
-	//Signature被设置为nil(仅仅是一个双重检验)
-	//PubKey被设置为所引用输出的PubKeyHash
-	//除了当前交易，其他所有交易都是“空的”，也就是说他们的Signature和PubKey字段被设置为nil
+	pubKey := append(privKey.PublicKey.X.Bytes(),privKey.PublicKey.Y.Bytes()...)
 	//输入是被分开签名的
-	for inID,vin := range txCopy.Vin {
+	for inID,vin := range tx.Vin {
 		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubkeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
-		//通过privKey对txCopy.ID进行签名
+		//通过privKey对修剪后的交易副本的哈希进行签名
 		//一个 ECDSA 签名就是一对数字
-		//将这对数字连接起来，并存储在输入的Signature字段
-		r,s,err := ecdsa.Sign(rand.Reader,&privKey,txCopy.ID)
+		//将这对数字连接起来，和公钥一起放进输入的解锁脚本
+		r,s,err := ecdsa.Sign(rand.Reader,&privKey,tx.signatureHash(inID,prevTx.Vout[vin.Vout]))
 		if err != nil {
 			log.Panic(err)
 		}
 		signature := append(r.Bytes(),s.Bytes()...)
  
-		tx.Vin[inID].Signature = signature
+		tx.Vin[inID].ScriptSig = pubKeyHashUnlockingScript(signature,pubKey)
 	}
  
 }
 
-//创建在签名中修剪后的交易副本,之所以要这个副本是因为简化了输入交易本身的签名和公钥
+//创建在签名中修剪后的交易副本,之所以要这个副本是因为签名不能签到自己，所有输入的解锁脚本都被去掉了
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
  
 	for _,vin := range tx.Vin {
-		inputs = append(inputs,TXInput{vin.Txid,vin.Vout,nil,nil})
+		inputs = append(inputs,TXInput{vin.Txid,vin.Vout,nil})
 	}
  
 	for _,vout := range tx.Vout {
-		outputs = append(outputs,TXOutput{vout.Value,vout.PubkeyHash})
+		outputs = append(outputs,TXOutput{vout.Value,vout.ScriptPubKey})
 	}
  
-	txCopy := Transaction{tx.ID,inputs,outputs}
+	txCopy := Transaction{tx.Version,tx.ID,inputs,outputs,tx.LockTime}
  
 	return txCopy
 }
 
-//验证 交易输入的签名
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+//第inID个输入的签名所签的哈希
+//将会被签署的是修剪后的交易副本，而不是一个完整交易
+//副本中当前输入的解锁脚本被设置为所引用输出的锁定脚本，其他输入的解锁脚本都是空的
+//版本3之前的交易当时签的是所引用输出的PubkeyHash，仍然按原来的方式计算
+func (tx *Transaction) signatureHash(inID int, prevOut TXOutput) []byte {
+	txCopy := tx.TrimmedCopy()
+	if tx.Version < 3 {
+		txCopy.Vin[inID].ScriptSig = pubKeyHashUnlockingScript(nil,prevOut.PubKeyHash())
+	} else {
+		txCopy.Vin[inID].ScriptSig = prevOut.ScriptPubKey
+	}
+	return txCopy.Hash()
+}
+
+//验证交易输入：每个输入的解锁脚本都要能解锁它引用的输出的锁定脚本
+//height和blockTime是交易所在区块的高度和时间，prevHeights是每笔被引用的交易所在区块的高度，检查输出的时间锁时要用
+func (tx *Transaction) Verify(prevTXs map[string]Transaction, prevHeights map[string]int, height int, blockTime int64) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
@@ -266,52 +433,61 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 			log.Panic("ERROR: Previous transaction is not correct")
 		}
 	}
-
-	txCopy := tx.TrimmedCopy() //修剪后的同一笔交易的副本
-	curve := elliptic.P256() //椭圆曲线实例用于生成密钥对
  
 	for inID,vin := range tx.Vin {
 		prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil //双重验证
-		txCopy.Vin[inID].PubKey = prevTX.Vout[vin.Vout].PubkeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
- 
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
- 
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
- 
-		rawPubKey := ecdsa.PublicKey{curve,&x,&y}
-		if ecdsa.Verify(&rawPubKey,txCopy.ID,&r,&s) == false {
+		prevOut := prevTX.Vout[vin.Vout]
+		ctx := &scriptContext{tx, inID, prevOut, prevHeights[hex.EncodeToString(vin.Txid)], height, blockTime, nil}
+		if verifyScript(vin.ScriptSig, prevOut.ScriptPubKey, ctx) != nil {
 			return false
 		}
 	}
 	return true
 }
 
+//用公钥检查对hash的签名，公钥和签名都是两个大整数连接起来的
+func verifySignature(pubKey, signature, hash []byte) bool {
+	if len(pubKey) == 0 || len(signature) == 0 {
+		return false
+	}
+	curve := elliptic.P256() //椭圆曲线实例用于生成密钥对
+
+	r := big.Int{}
+	s := big.Int{}
+	sigLen := len(signature)
+	r.SetBytes(signature[:(sigLen / 2)])
+	s.SetBytes(signature[(sigLen / 2):])
+
+	x := big.Int{}
+	y := big.Int{}
+	keyLen := len(pubKey)
+	x.SetBytes(pubKey[:(keyLen / 2)])
+	y.SetBytes(pubKey[(keyLen / 2):])
+	if !curve.IsOnCurve(&x,&y) {
+		return false
+	}
+
+	rawPubKey := ecdsa.PublicKey{curve,&x,&y}
+	return ecdsa.Verify(&rawPubKey,hash,&r,&s)
+}
+
 //把交易转换成我们能正常读的形式
 func (tx Transaction) String() string {
 	var lines []string
 	lines = append(lines, fmt.Sprintf("--Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf(" LockTime: %d", tx.LockTime))
+	}
 	for i, input := range tx.Vin {
 		lines = append(lines, fmt.Sprintf(" -Input %d:", i))
 		lines = append(lines, fmt.Sprintf("  TXID: %x", input.Txid))
 		lines = append(lines, fmt.Sprintf("  Out:  %d", input.Vout))
-		lines = append(lines, fmt.Sprintf("  Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("  PubKey:%x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("  ScriptSig: %s", disasmScript(input.ScriptSig)))
 	}
 	for i, output := range tx.Vout {
 		lines = append(lines, fmt.Sprintf(" -Output %d:", i))
 		lines = append(lines, fmt.Sprintf("  Value: %d", output.Value))
-		lines = append(lines, fmt.Sprintf("  Script: %x", output.PubkeyHash))
+		lines = append(lines, fmt.Sprintf("  Script: %s", disasmScript(output.ScriptPubKey)))
 	}
 	return strings.Join(lines,"\n")
 
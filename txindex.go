@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"github.com/boltdb/bolt"
+)
+
+//交易索引的桶，键是交易ID，值是交易所在的主链区块哈希和它在区块中的位置
+//这个索引是可选的：桶存在时才会在连接和回滚区块时维护，用 reindextx 或者 -txindex 建立
+//没有索引时FindTransaction只能从顶端区块往回逐个区块查找
+const txIndexBucket = "txindex"
+
+var errNoTxIndex = errors.New("Transaction index is not enabled")
+
+//交易索引中的一条记录
+type txIndexEntry struct {
+	BlockHash []byte
+	Position  int
+}
+
+//序列化交易索引中的一条记录，格式是 bytes BlockHash + u32 Position，见encoding.go
+func (entry txIndexEntry) serialize() []byte {
+	e := &encoder{}
+	e.bytes(entry.BlockHash)
+	e.uint32(uint32(entry.Position))
+	return e.buf.Bytes()
+}
+
+//反序列化交易索引中的一条记录
+func deserializeTxIndexEntry(data []byte) txIndexEntry {
+	d := &decoder{data: data}
+	entry := txIndexEntry{d.bytes(), int(d.uint32())}
+	if err := d.finish(); err != nil {
+		log.Panic(err)
+	}
+	return entry
+}
+
+//在事务tx中把区块中的交易加入交易索引，没有开启交易索引时什么都不做
+func indexBlockTransactions(tx *bolt.Tx, block *Block) {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return
+	}
+
+	for i, transaction := range block.Transactions {
+		err := b.Put(transaction.ID, txIndexEntry{block.Hash, i}.serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+//在事务tx中把回滚的区块中的交易从交易索引中删掉
+//只删除确实指向这个区块的记录，同一笔交易可能已经被新分支上的区块重新索引了
+func unindexBlockTransactions(tx *bolt.Tx, block *Block) {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return
+	}
+
+	for _, transaction := range block.Transactions {
+		data := b.Get(transaction.ID)
+		if data == nil || !bytes.Equal(deserializeTxIndexEntry(data).BlockHash, block.Hash) {
+			continue
+		}
+		err := b.Delete(transaction.ID)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+//是否开启了交易索引
+func (bc *Blockchain) HasTxIndex() bool {
+	exists := false
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(txIndexBucket)) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return exists
+}
+
+//重建交易索引：删掉旧的桶，再遍历主链把所有交易写进去，返回索引的交易数
+//还没有交易索引时，这样也就开启了交易索引
+func (bc *Blockchain) ReindexTransactions() int {
+	count := 0
+
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(txIndexBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			log.Panic(err)
+		}
+		_, err = tx.CreateBucket([]byte(txIndexBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		if len(bc.tip) == 0 {
+			return nil
+		}
+
+		blocks := tx.Bucket([]byte(blocksBucket))
+		hash := bc.tip
+		for {
+			block := DeserializeBlock(blocks.Get(hash))
+			indexBlockTransactions(tx, block)
+			count += len(block.Transactions)
+
+			if len(block.PrevBlockHash) == 0 {
+				break
+			}
+			hash = block.PrevBlockHash
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return count
+}
+
+//通过交易索引找到交易和它所在的区块
+//没有开启交易索引时返回errNoTxIndex，开启了但是找不到时说明交易不在主链上
+func (bc *Blockchain) findIndexedTransaction(ID []byte) (Transaction, Block, error) {
+	var entry *txIndexEntry
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(txIndexBucket))
+		if b == nil {
+			return errNoTxIndex
+		}
+		if data := b.Get(ID); data != nil {
+			found := deserializeTxIndexEntry(data)
+			entry = &found
+		}
+		return nil
+	})
+	if err != nil {
+		return Transaction{}, Block{}, err
+	}
+	if entry == nil {
+		return Transaction{}, Block{}, errors.New("Transaction is not found")
+	}
+
+	block, err := bc.GetBlock(entry.BlockHash)
+	if err != nil {
+		log.Panic(err)
+	}
+	if entry.Position >= len(block.Transactions) || !bytes.Equal(block.Transactions[entry.Position].ID, ID) {
+		log.Panicf("ERROR: Transaction index is broken at %x, run reindextx", ID)
+	}
+
+	return *block.Transactions[entry.Position], block, nil
+}
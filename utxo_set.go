@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+//存放UTXO集合的桶，和blocksBucket放在同一个数据库文件里
+const utxoBucket = "chainstate"
+
+//UTXO集合的格式，保存在blocksBucket的utxoFormatKey下
+//格式1记录了输出所在区块的高度和是否是coinbase，没有这个键的UTXO集合在打开区块链时会被重建
+const utxoFormat = "1"
+
+var utxoFormatKey = []byte("utxoformat")
+
+//UTXO集合，是从区块链所有交易中构建出来的未花费交易输出的缓存
+//这样查询余额和花费时就不用每次从顶端区块迭代到创世块了
+type UTXOSet struct {
+	Blockchain *Blockchain
+}
+
+//在创建新的输出前，我们首先必须找到所有的未花费输出，并且确保它们存储了足够的值
+//我们创建两个输出：
+//1.	一个由接收者地址锁定。这是给实际给其他地址转移的币。
+//2.	一个由发送者地址锁定。这是一个找零。只有当未花费输出超过新交易所需时产生。记住：输出是不可再分的
+//现在这个方法直接从UTXO集合中查找，不再遍历整条链
+//pending不为nil时，跳过已经被交易池中的交易花费了的输出
+//时间锁还没有解开的输出和还不够成熟的coinbase输出也会被跳过，新交易是按放进下一个区块来检查的
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int, pending *Mempool) (int, map[string][]int) {
+	unspentOutputs := make(map[string][]int)
+	accumulated := 0
+	db := u.Blockchain.db
+	height := u.Blockchain.GetBestHeight() + 1
+	now := time.Now().Unix()
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			txID := hex.EncodeToString(k)
+			outs := DeserializeOutputs(v)
+			if !outs.IsMature(height) {
+				continue
+			}
+
+			for outIdx, out := range outs.Outputs {
+				if pending != nil && pending.IsSpent(k, outIdx) {
+					continue
+				}
+				if !timeLockReady(out.ScriptPubKey, outs.Height, height, now) {
+					continue
+				}
+				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
+					accumulated += out.Value
+					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return accumulated, unspentOutputs
+}
+
+//从UTXO集合中找到被pubKeyHash锁定的所有未花费输出，用于计算余额
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
+	var UTXOs []TXOutput
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+
+			for _, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) {
+					UTXOs = append(UTXOs, out)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return UTXOs
+}
+
+//被pubKeyHash锁定的未花费输出的总额，分成下一个区块就能花费的和还不能花费的两部分
+//还不能花费的是不够成熟的coinbase输出和时间锁还没有解开的输出，和FindSpendableOutputs跳过的输出一样
+func (u UTXOSet) GetBalance(pubKeyHash []byte) (int, int) {
+	mature, immature := 0, 0
+	db := u.Blockchain.db
+	height := u.Blockchain.GetBestHeight() + 1
+	now := time.Now().Unix()
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+
+			for _, out := range outs.Outputs {
+				if !out.IsLockedWithKey(pubKeyHash) {
+					continue
+				}
+				if outs.IsMature(height) && timeLockReady(out.ScriptPubKey, outs.Height, height, now) {
+					mature += out.Value
+				} else {
+					immature += out.Value
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return mature, immature
+}
+
+//在UTXO集合中查找交易txID的第vout个输出，找不到说明它不存在或者已经被花费了
+func (u UTXOSet) FindOutput(txID []byte, vout int) (TXOutput, bool) {
+	outs, found := u.FindOutputs(txID)
+	if !found {
+		return TXOutput{}, false
+	}
+	out, found := outs.Outputs[vout]
+	return out, found
+}
+
+//在UTXO集合中查找交易txID还没有被花费的所有输出
+func (u UTXOSet) FindOutputs(txID []byte) (TXOutputs, bool) {
+	var outs TXOutputs
+	found := false
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		outsBytes := b.Get(txID)
+		if outsBytes == nil {
+			return nil
+		}
+
+		outs = DeserializeOutputs(outsBytes)
+		found = true
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return outs, found
+}
+
+//UTXO集合中所有未花费输出的总额，也就是当前流通的币的总量
+func (u UTXOSet) TotalValue() int {
+	db := u.Blockchain.db
+	total := 0
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			for _, out := range outs.Outputs {
+				total += out.Value
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return total
+}
+
+//返回UTXO集合中的交易数
+func (u UTXOSet) CountTransactions() int {
+	db := u.Blockchain.db
+	counter := 0
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			counter++
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return counter
+}
+
+//重建UTXO集合：删掉旧的桶，再遍历整条链把所有未花费输出写进去
+func (u UTXOSet) Reindex() {
+	err := u.Blockchain.db.Update(func(tx *bolt.Tx) error {
+		u.rebuild(tx, u.Blockchain.tip)
+		return tx.Bucket([]byte(blocksBucket)).Put(utxoFormatKey, []byte(utxoFormat))
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+//在事务tx中把UTXO集合重建成hash这个区块连接完以后的状态
+func (u UTXOSet) rebuild(tx *bolt.Tx, hash []byte) {
+	bucketName := []byte(utxoBucket)
+
+	err := tx.DeleteBucket(bucketName)
+	if err != nil && err != bolt.ErrBucketNotFound {
+		log.Panic(err)
+	}
+	b, err := tx.CreateBucket(bucketName)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for txID, outs := range findUTXO(tx.Bucket([]byte(blocksBucket)), hash) {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = b.Put(key, outs.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+//用新挖出的区块更新UTXO集合
+//区块里每笔交易的输入所引用的输出被移除，交易自己的输出被加入
+func (u UTXOSet) Update(block *Block) {
+	db := u.Blockchain.db
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		return u.connectBlock(tx, block)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+//在事务tx中把区块连接到UTXO集合，同时保存区块的撤销数据（被它花费掉的输出），回滚时要用
+//连接之前先用当前的UTXO集合验证区块中的交易，验证失败时不做任何修改，返回BlockValidationError
+func (u UTXOSet) connectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	var spent []spentOutput
+
+	if err := checkBlockTransactions(b, block); err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, vin := range tx.Vin {
+				outsBytes := b.Get(vin.Txid)
+				if outsBytes == nil {
+					continue
+				}
+				outs := DeserializeOutputs(outsBytes)
+				if out, ok := outs.Outputs[vin.Vout]; ok {
+					spent = append(spent, spentOutput{vin.Txid, vin.Vout, out, outs.Height, outs.Coinbase})
+				}
+				delete(outs.Outputs, vin.Vout)
+
+				//如果这笔交易的输出都被花完了，就把整个键删掉
+				if len(outs.Outputs) == 0 {
+					err := b.Delete(vin.Txid)
+					if err != nil {
+						log.Panic(err)
+					}
+				} else {
+					err := b.Put(vin.Txid, outs.Serialize())
+					if err != nil {
+						log.Panic(err)
+					}
+				}
+			}
+		}
+
+		newOutputs := TXOutputs{make(map[int]TXOutput), block.Height, tx.IsCoinbase()}
+		for outIdx, out := range tx.Vout {
+			newOutputs.Outputs[outIdx] = out
+		}
+
+		err := b.Put(tx.ID, newOutputs.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	undo, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+	err = undo.Put(block.Hash, serializeUndo(spent))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return nil
+}
+
+//在事务tx中把区块从UTXO集合中回滚：删掉区块中交易产生的输出，再把它花费掉的输出恢复回来
+func (u UTXOSet) disconnectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	undo := tx.Bucket([]byte(undoBucket))
+	if undo == nil || undo.Get(block.Hash) == nil {
+		return errMissingUndo
+	}
+
+	for _, tx := range block.Transactions {
+		err := b.Delete(tx.ID)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	for _, spent := range deserializeUndo(undo.Get(block.Hash)) {
+		outs := TXOutputs{make(map[int]TXOutput), spent.Height, spent.Coinbase}
+		if outsBytes := b.Get(spent.Txid); outsBytes != nil {
+			outs = DeserializeOutputs(outsBytes)
+		}
+		outs.Outputs[spent.Vout] = spent.Output
+
+		err := b.Put(spent.Txid, outs.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return undo.Delete(block.Hash)
+}
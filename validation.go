@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+//区块时间戳最多可以比本机时间超前多少秒
+const maxFutureBlockTime = 2 * 60 * 60
+
+//计算中位时间用到的区块数，新区块的时间戳不能早于前面这么多个区块时间戳的中位数
+const medianTimeSpan = 11
+
+//区块已经保存过，或者父区块还不知道，这两种情况不说明区块无效，只是现在不处理
+var (
+	ErrBlockKnown  = errors.New("Block is already known")
+	ErrOrphanBlock = errors.New("Parent of block is not found")
+)
+
+//区块验证失败的原因，可以用errors.Is判断BlockValidationError属于哪一种
+var (
+	ErrBadBlockHash   = errors.New("Block hash does not match its header and merkle root")
+	ErrMutatedBlock   = errors.New("Block transactions repeat a subtree of the merkle tree")
+	ErrBadProofOfWork = errors.New("Block hash does not meet the difficulty target")
+	ErrBadDifficulty  = errors.New("Block difficulty is not the one the chain rules expect")
+	ErrBadGenesis     = errors.New("Block is a different genesis block")
+	ErrBadVersion     = errors.New("Block version is lower than the version of its parent")
+	ErrInvalidParent  = errors.New("Parent of block is invalid")
+	ErrBadHeight      = errors.New("Block height does not follow its parent")
+	ErrBadTimestamp   = errors.New("Block timestamp is out of range")
+	ErrBadCoinbase    = errors.New("Block coinbase is not valid")
+	ErrDuplicateTx    = errors.New("Block contains a transaction twice")
+	ErrBadTxID        = errors.New("Transaction ID does not match its contents")
+	ErrBadTxVersion   = errors.New("Transaction version is older than the current version")
+	ErrTxIDInUse      = errors.New("Transaction ID already has unspent outputs")
+	ErrMissingInput   = errors.New("Transaction input is not found or already spent")
+	ErrDoubleSpend    = errors.New("Two transactions in block spend the same output")
+	ErrBadSignature   = errors.New("Transaction signature is not valid")
+	ErrBadValue       = errors.New("Transaction output value is negative, too large or more than its inputs")
+	ErrBadLockTime    = errors.New("Transaction is locked until a later block height or time")
+	ErrImmatureSpend  = errors.New("Transaction spends a coinbase output that is not mature yet")
+)
+
+//区块验证失败时返回的错误，Err是上面的某一个原因
+type BlockValidationError struct {
+	Hash   []byte
+	Err    error
+	Detail string
+}
+
+func (e *BlockValidationError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("Block %x is invalid: %s", e.Hash, e.Err)
+	}
+	return fmt.Sprintf("Block %x is invalid: %s: %s", e.Hash, e.Err, e.Detail)
+}
+
+func (e *BlockValidationError) Unwrap() error {
+	return e.Err
+}
+
+//创建一个区块验证错误，detail是补充说明，可以为空
+func blockError(block *Block, err error, detail string) error {
+	return &BlockValidationError{block.Hash, err, detail}
+}
+
+/*验证区块本身以及它和父区块的关系，这些检查不需要UTXO集合
+1.	区块哈希确实是区块头数据（包括交易的Merkle根）的哈希，Merkle树里没有重复的子树
+2.	父区块存在并且有效，区块头通过checkHeader的检查
+3.	第一笔交易是coinbase，并且只有这一笔coinbase，没有重复的交易
+4.	每笔交易的ID都是按ComputeID算出来的，签名不覆盖ID，不检查的话可以给签过名的交易随便换一个ID
+	版本0的区块是gob编码时期的，其中有的交易按规则算不出原来的ID（见legacyBlockReproducible），不检查
+5.	版本1以上的区块中的交易都是当前的交易版本txVersion，旧版本的交易只会出现在之前保存的旧区块里
+交易的输入、签名和金额要在区块被连接到UTXO集合时才能检查，见checkBlockTransactions
+*/
+func (bc *Blockchain) checkBlock(block *Block) error {
+	//只要区块的任何数据被改动，重新计算出的哈希就对不上了
+	header := block.Header()
+	if !bytes.Equal(header.Hash(), block.Hash) {
+		return blockError(block, ErrBadBlockHash, "")
+	}
+	//重复了末尾子树的交易列表和原来的有效区块哈希一样，只说明这份数据被改过，不说明这个哈希的区块无效
+	//这里直接丢掉，不保存也不标记无效，以后还能收到原来的区块
+	if block.merkleTree().mutated {
+		return blockError(block, ErrMutatedBlock, "")
+	}
+
+	var parent *BlockHeader
+	if len(block.PrevBlockHash) == 0 {
+		//我们的链上已经有了创世块，只有空链才能接收一个创世块，并且必须是这个网络固定的那个
+		if bc.tip != nil || !bytes.Equal(block.Hash, params.GenesisHashBytes()) {
+			return blockError(block, ErrBadGenesis, "")
+		}
+	} else {
+		//父区块只需要区块头
+		var err error
+		parent, err = bc.GetHeader(block.PrevBlockHash)
+		if err != nil {
+			return ErrOrphanBlock
+		}
+		if bc.isInvalid(block.PrevBlockHash) {
+			return blockError(block, ErrInvalidParent, "")
+		}
+	}
+	if err := checkHeader(bc.db, block.Hash, header, parent); err != nil {
+		return err
+	}
+
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return blockError(block, ErrBadCoinbase, "first transaction is not coinbase")
+	}
+	txIDs := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if i > 0 && tx.IsCoinbase() {
+			return blockError(block, ErrBadCoinbase, "more than one coinbase")
+		}
+		txID := hex.EncodeToString(tx.ID)
+		if block.Version >= 1 && tx.Version < txVersion {
+			return blockError(block, ErrBadTxVersion, txID)
+		}
+		if block.Version >= 1 && !bytes.Equal(tx.ComputeID(), tx.ID) {
+			return blockError(block, ErrBadTxID, txID)
+		}
+		if txIDs[txID] {
+			return blockError(block, ErrDuplicateTx, txID)
+		}
+		txIDs[txID] = true
+	}
+
+	return nil
+}
+
+/*验证区块头和父区块的关系，只需要区块头，轻节点同步区块头时也用它，parent为nil时是创世块
+1.	高度是父区块高度加1，版本不低于父区块的版本
+2.	难度是链的规则要求的难度，并且满足工作量证明
+3.	时间戳不早于前面11个区块的中位时间，也不能比现在超前太多
+db中要有父区块往前的区块头，计算难度和中位时间时要用到
+*/
+func checkHeader(db *bolt.DB, hash []byte, header *BlockHeader, parent *BlockHeader) error {
+	if parent == nil {
+		if header.Height != 0 {
+			return &BlockValidationError{hash, ErrBadHeight, ""}
+		}
+	} else {
+		if header.Height != parent.Height+1 {
+			return &BlockValidationError{hash, ErrBadHeight, fmt.Sprintf("height %d after parent height %d", header.Height, parent.Height)}
+		}
+		//规则是跟着区块版本启用的，链上出现新版本的区块以后就不能再用旧版本绕过新规则了
+		if header.Version < parent.Version {
+			return &BlockValidationError{hash, ErrBadVersion, fmt.Sprintf("version %d after parent version %d", header.Version, parent.Version)}
+		}
+	}
+
+	expectedBits := params.GenesisBits
+	if parent != nil {
+		expectedBits = nextBits(db, parent)
+	}
+	if header.Bits != expectedBits {
+		return &BlockValidationError{hash, ErrBadDifficulty, fmt.Sprintf("bits %d, expected %d", header.Bits, expectedBits)}
+	}
+	if !header.Validate(expectedBits) {
+		return &BlockValidationError{hash, ErrBadProofOfWork, ""}
+	}
+
+	if header.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return &BlockValidationError{hash, ErrBadTimestamp, "too far in the future"}
+	}
+	if parent != nil {
+		median := medianTimePast(db, header.PrevBlockHash)
+		if header.Timestamp < median {
+			return &BlockValidationError{hash, ErrBadTimestamp, fmt.Sprintf("earlier than median time %d", median)}
+		}
+	}
+
+	return nil
+}
+
+//以hash为顶端的前medianTimeSpan个区块时间戳的中位数
+func medianTimePast(db *bolt.DB, hash []byte) int64 {
+	var timestamps []int64
+	bci := &HeaderIterator{hash, db}
+
+	for i := 0; i < medianTimeSpan; i++ {
+		_, h := bci.Next()
+		timestamps = append(timestamps, h.Timestamp)
+		if len(h.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+
+	return timestamps[len(timestamps)/2]
+}
+
+//区块是否已经被标记为无效
+func (bc *Blockchain) isInvalid(hash []byte) bool {
+	invalid := false
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(blockIndexBucket))
+		if index == nil {
+			return nil
+		}
+		if data := index.Get(hash); data != nil {
+			invalid = deserializeBlockIndexEntry(data).Invalid
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return invalid
+}
+
+//用UTXO集合b验证区块中的交易，b必须正好是连接完父区块之后的状态
+//每个输入都必须引用一个还没有被花费的输出，同一个区块内不能有两笔交易花费同一个输出
+//解锁脚本必须能解锁引用的输出，输出金额不能是负数，输出总额不能超过输入总额，coinbase领取的金额不能超过挖矿奖励加上手续费
+//交易的LockTime必须已经到了，输出的时间锁由脚本检查
+//交易ID在UTXO集合中不能还有未花费的输出，否则连接区块时会把它们覆盖掉（和比特币的BIP30一样）
+//版本2以上的区块中，coinbase的输出要过了params.CoinbaseMaturity个区块才能花费，之前的区块已经在链上了，不再检查
+//交易按顺序检查，后面的交易可以花费同一区块中前面交易的输出
+func checkBlockTransactions(b *bolt.Bucket, block *Block) error {
+	spentInBlock := make(map[string]bool)
+	createdInBlock := make(map[string]TXOutput)
+	fees := 0
+
+	for _, tx := range block.Transactions {
+		if !tx.IsFinal(block.Height, block.Timestamp) {
+			return blockError(block, ErrBadLockTime, fmt.Sprintf("%x", tx.ID))
+		}
+		if b.Get(tx.ID) != nil {
+			return blockError(block, ErrTxIDInUse, fmt.Sprintf("%x", tx.ID))
+		}
+		if tx.IsCoinbase() {
+			if _, ok := outputsValue(tx); !ok {
+				return blockError(block, ErrBadValue, fmt.Sprintf("%x", tx.ID))
+			}
+			for outIdx, out := range tx.Vout {
+				createdInBlock[outpointKey(tx.ID, outIdx)] = out
+			}
+			continue
+		}
+
+		prevTXs := make(map[string]Transaction)
+		prevHeights := make(map[string]int)
+		inputValue := 0
+		for _, vin := range tx.Vin {
+			key := outpointKey(vin.Txid, vin.Vout)
+			if spentInBlock[key] {
+				return blockError(block, ErrDoubleSpend, key)
+			}
+
+			out, ok := createdInBlock[key]
+			prevHeight := block.Height
+			mature := !bytes.Equal(vin.Txid, block.Transactions[0].ID)
+			if !ok {
+				if outsBytes := b.Get(vin.Txid); outsBytes != nil {
+					outs := DeserializeOutputs(outsBytes)
+					out, ok = outs.Outputs[vin.Vout]
+					prevHeight = outs.Height
+					mature = outs.IsMature(block.Height)
+				}
+			}
+			if !ok {
+				return blockError(block, ErrMissingInput, key)
+			}
+			if !mature && block.Version >= 2 {
+				return blockError(block, ErrImmatureSpend, key)
+			}
+			spentInBlock[key] = true
+			inputValue += out.Value
+
+			//验证签名只需要被引用的那个输出，用它拼出一个之前交易的副本
+			prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
+			prevTX.ID = vin.Txid
+			for len(prevTX.Vout) <= vin.Vout {
+				prevTX.Vout = append(prevTX.Vout, TXOutput{})
+			}
+			prevTX.Vout[vin.Vout] = out
+			prevTXs[hex.EncodeToString(vin.Txid)] = prevTX
+			prevHeights[hex.EncodeToString(vin.Txid)] = prevHeight
+		}
+
+		if !tx.Verify(prevTXs, prevHeights, block.Height, block.Timestamp) {
+			return blockError(block, ErrBadSignature, fmt.Sprintf("%x", tx.ID))
+		}
+
+		outputValue, ok := outputsValue(tx)
+		for outIdx, out := range tx.Vout {
+			createdInBlock[outpointKey(tx.ID, outIdx)] = out
+		}
+		if !ok || outputValue > inputValue {
+			return blockError(block, ErrBadValue, fmt.Sprintf("%x", tx.ID))
+		}
+		fees += inputValue - outputValue
+	}
+
+	reward, _ := outputsValue(block.Transactions[0])
+	if reward > BlockSubsidy(block.Height)+fees {
+		return blockError(block, ErrBadCoinbase, fmt.Sprintf("pays %d, but subsidy plus fees is only %d", reward, BlockSubsidy(block.Height)+fees))
+	}
+
+	return nil
+}
+
+
+//交易输出的总额，输出金额不能是负数，单个输出和总额都不能超过币的总量上限，否则返回false
+//只比较输出总额和输入总额的话，一正一负两个输出就能凭空造出任意多的币
+func outputsValue(tx *Transaction) (int, bool) {
+	total := 0
+	for _, out := range tx.Vout {
+		if out.Value < 0 || out.Value > params.MaxSupply {
+			return 0, false
+		}
+		total += out.Value
+		if total > params.MaxSupply {
+			return 0, false
+		}
+	}
+	return total, true
+}
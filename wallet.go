@@ -10,13 +10,19 @@ import (
 	"os"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"encoding/gob"
 	"golang.org/x/crypto/ripemd160"
 )
 
-const version = byte(0x00)
-
-const walletFile = "wallet.dat"
+//和数据库文件一样，用环境变量NODE_ID区分每个节点的钱包文件
+func walletFileName() string {
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		return dataFile(params.WalletFile)
+	}
+	return dataFile(fmt.Sprintf("wallet_%s.dat", nodeID))
+}
 
 const addressChecksumLen = 4 //对校验位一般取4位
  
@@ -47,13 +53,34 @@ func newKeyPair() (ecdsa.PrivateKey,[]byte) {
  
 	return *private,pubKey
 }
+
+//用私钥的D恢复出完整的私钥，公钥X、Y可以由D算出来
+func privateKeyFromD(d []byte) ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	private := ecdsa.PrivateKey{}
+	private.PublicKey.Curve = curve
+	private.D = new(big.Int).SetBytes(d)
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(d)
+
+	return private
+}
+
+//钱包锁定时只有公钥，私钥的D是空的，不能用来签名
+func publicOnlyKey(pubKey []byte) ecdsa.PrivateKey {
+	private := ecdsa.PrivateKey{}
+	private.PublicKey.Curve = elliptic.P256()
+	private.PublicKey.X = new(big.Int).SetBytes(pubKey[:len(pubKey)/2])
+	private.PublicKey.Y = new(big.Int).SetBytes(pubKey[len(pubKey)/2:])
+
+	return private
+}
  
 //生成一个地址
 func (w Wallet) GetAddress() []byte {
 	//调用公钥哈希函数，实现RIPEMD160(SHA256(Public Key))
 	pubKeyHash := HashPubKey(w.PublicKey)
-	//存储version和公钥哈希的切片
-	versionedPayload := append([]byte{version},pubKeyHash...)
+	//存储version和公钥哈希的切片，version是当前网络普通地址的版本
+	versionedPayload := append([]byte{params.PubKeyHashAddrID},pubKeyHash...)
 	//调用checksum函数，对上面的切片进行双重哈希后，取出哈希后的切片的前面部分作为检验位的值
 	checksum := checksum(versionedPayload)
 	//把校验位加到上面切片后面
@@ -64,6 +91,30 @@ func (w Wallet) GetAddress() []byte {
 	return address
 }
  
+//由公钥哈希得到地址，和GetAddress一样是 Base58(version + 公钥哈希 + 校验位)
+func PubKeyHashToAddress(pubKeyHash []byte) string {
+	return hashToAddress(params.PubKeyHashAddrID, pubKeyHash)
+}
+
+//Base58(addressVersion + 哈希 + 校验位)
+func hashToAddress(addressVersion byte, hash []byte) string {
+	versionedPayload := append([]byte{addressVersion}, hash...)
+	fullPayload := append(versionedPayload, checksum(versionedPayload)...)
+
+	return string(Base58Encode(fullPayload))
+}
+
+//是否是多重签名地址，地址要先用ValidateAddress检查过
+func IsMultisigAddress(address string) bool {
+	return Base58Decode([]byte(address))[0] == params.ScriptHashAddrID
+}
+
+//从地址中取出公钥哈希，地址要先用ValidateAddress检查过
+func AddressToPubKeyHash(address string) []byte {
+	pubKeyHash := Base58Decode([]byte(address))
+	return pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
+}
+
 //公钥哈希函数，实现RIPEMD160(SHA256(Public Key))
 func HashPubKey(pubKey []byte) []byte {
 	//先hash公钥
@@ -98,6 +149,10 @@ func ValidateAddress(address string) bool {
 	if len(pubKeyHash) > addressChecksumLen{
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
+	//其他网络的地址不能用
+	if version != params.PubKeyHashAddrID && version != params.ScriptHashAddrID {
+		return false
+	}
 	pubKeyHash = pubKeyHash[1:len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version},pubKeyHash...))
 	//比较拆分出的校验位与计算出的目标校验位是否相等
@@ -108,14 +163,28 @@ func ValidateAddress(address string) bool {
 }
 
 //创建一个钱包集合的结构体
+//加密的钱包在内存中保存加密后的私钥，解锁以后key是从口令推导出的密钥，锁定时为nil
+//HD钱包的seed是派生所有地址的种子，nextIndex是下一个要派生的地址的序号
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	encrypted  bool
+	salt       []byte
+	check      []byte
+	key        []byte
+	sealed     map[string][]byte
+	seed       []byte
+	sealedSeed []byte
+	nextIndex  int
+	multisig   map[string][]byte
 }
 
 // 实例化一个钱包集合，
 func NewWallets() (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.sealed = make(map[string][]byte)
+	wallets.multisig = make(map[string][]byte)
 
 	err := wallets.LoadFromFile()
 
@@ -123,8 +192,14 @@ func NewWallets() (*Wallets, error) {
 }
 
 // 将 Wallet 添加进 Wallets
+//HD钱包的新地址由种子派生，否则随机生成
 func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+	var wallet *Wallet
+	if ws.IsHD() {
+		wallet = ws.deriveNext()
+	} else {
+		wallet = NewWallet()
+	}
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 	ws.Wallets[address] = wallet
 	return address
@@ -145,35 +220,106 @@ func (ws Wallets) GetWallet(address string) Wallet {
 }
  
 // 从文件中加载钱包s
+//加密的钱包加载后是锁定的，除非这个进程中之前解锁过并且还没有过期
+//旧版本直接用gob保存的明文钱包文件会被转换成新格式保存
 func (ws *Wallets) LoadFromFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	if _, err := os.Stat(walletFileName()); os.IsNotExist(err) {
 		return err
 	}
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(walletFileName())
 	if err != nil {
 		log.Panic(err)
 	}
-	var wallets Wallets
+
+	var data walletFileData
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&data)
+	if err != nil || data.Version == 0 {
+		ws.loadLegacy(fileContent)
+		ws.SaveToFile()
+		fmt.Printf("Wallet file %s is converted to the new format, run encryptwallet to protect it with a passphrase\n", walletFileName())
+		return nil
+	}
+
+	ws.encrypted = data.Encrypted
+	ws.salt = data.Salt
+	ws.check = data.Check
+	ws.nextIndex = data.NextIndex
+	for address, script := range data.Multisig {
+		ws.multisig[address] = script
+	}
+	if data.Encrypted {
+		ws.sealedSeed = data.Seed
+	} else {
+		ws.seed = data.Seed
+	}
+	for address, key := range data.Keys {
+		if data.Encrypted {
+			ws.Wallets[address] = &Wallet{publicOnlyKey(key.PublicKey), key.PublicKey}
+			ws.sealed[address] = key.PrivateKey
+		} else {
+			ws.Wallets[address] = &Wallet{privateKeyFromD(key.PrivateKey), key.PublicKey}
+		}
+	}
+	if ws.encrypted {
+		ws.loadUnlock()
+	}
+
+	return nil
+}
+
+//加载旧版本的钱包文件，里面是直接用gob保存的Wallets
+func (ws *Wallets) loadLegacy(fileContent []byte) {
+	var wallets struct {
+		Wallets map[string]*Wallet
+	}
 	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
+	err := decoder.Decode(&wallets)
 	if err != nil {
 		log.Panic(err)
 	}
 	ws.Wallets = wallets.Wallets
-	return nil
 }
 
 // 将钱包s保存到文件
-func (ws Wallets) SaveToFile() {
+//私钥只保存D，钱包加密时D用口令推导出的密钥加密；文件只有自己可以读写
+func (ws *Wallets) SaveToFile() {
+	data := walletFileData{walletFileVersion, ws.encrypted, ws.salt, ws.check, make(map[string]walletKey), ws.seed, ws.nextIndex, ws.multisig}
+	if ws.encrypted && ws.IsHD() {
+		if ws.sealedSeed == nil {
+			ws.sealedSeed = sealWalletData(ws.key, ws.seed, "seed")
+		}
+		data.Seed = ws.sealedSeed
+	}
+	for address, wallet := range ws.Wallets {
+		if !ws.encrypted {
+			data.Keys[address] = walletKey{wallet.PublicKey, wallet.PrivateKey.D.Bytes()}
+			continue
+		}
+		if _, ok := ws.sealed[address]; !ok {
+			if ws.key == nil {
+				log.Panic(ErrWalletLocked)
+			}
+			ws.sealed[address] = sealWalletData(ws.key, wallet.PrivateKey.D.Bytes(), address)
+		}
+		data.Keys[address] = walletKey{wallet.PublicKey, ws.sealed[address]}
+	}
+
 	var content bytes.Buffer
-	gob.Register(elliptic.P256())
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
+	err := encoder.Encode(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	//先写到临时文件再改名，写到一半出错也不会把原来的钱包文件弄坏
+	tmpFile := walletFileName() + ".tmp"
+	err = ioutil.WriteFile(tmpFile, content.Bytes(), 0600)
 	if err != nil {
 		log.Panic(err)
 	}
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = os.Rename(tmpFile, walletFileName())
 	if err != nil {
 		log.Panic(err)
 	}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"golang.org/x/crypto/scrypt"
+)
+
+//钱包文件格式的版本，之前直接用gob保存Wallets的钱包文件没有版本号，读出来是0
+const walletFileVersion = 2
+
+//scrypt的参数，N越大从口令推导密钥越慢，暴力猜口令也越慢
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	walletKeyLen = 32 //AES-256
+	walletSalt   = 16
+)
+
+//加密钱包时用口令加密这段固定数据，能解密它就说明口令是对的
+var walletCheckData = []byte("wallet passphrase check")
+
+//钱包加密相关的错误
+var (
+	ErrWalletLocked       = errors.New("Wallet is locked, unlock it with the walletpassphrase RPC first")
+	ErrWalletEncrypted    = errors.New("Wallet is already encrypted")
+	ErrWalletNotEncrypted = errors.New("Wallet is not encrypted")
+	ErrWrongPassphrase    = errors.New("The wallet passphrase is not correct")
+)
+
+//保存在钱包文件中的内容
+//公钥不加密，这样钱包锁定时也能列出地址、查询余额；Encrypted为true时私钥和HD种子是用口令推导出的密钥加密过的
+type walletFileData struct {
+	Version   int
+	Encrypted bool
+	Salt      []byte
+	Check     []byte
+	Keys      map[string]walletKey
+	Seed      []byte
+	NextIndex int
+	Multisig  map[string][]byte //加入钱包的多重签名地址和它们的脚本
+}
+
+//钱包文件中的一个密钥对，PrivateKey未加密时是私钥的D，加密时是nonce+密文
+type walletKey struct {
+	PublicKey  []byte
+	PrivateKey []byte
+}
+
+//解锁后解出的密钥和过期时间，只保存在内存里，不能写到磁盘上
+//常驻的节点用RPC的walletpassphrase解锁，过期之前的RPC请求可以签名；命令行每次运行都是一个新进程，签名的命令直接读取口令
+type walletUnlock struct {
+	Key    []byte
+	Expire int64 //为0时一直解锁到进程退出
+}
+
+//这个进程中钱包的解锁状态，为nil时钱包是锁定的
+var unlockedWallet *walletUnlock
+
+//从口令和盐推导出加密私钥用的密钥
+func deriveWalletKey(passphrase string, salt []byte) []byte {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, walletKeyLen)
+	if err != nil {
+		log.Panic(err)
+	}
+	return key
+}
+
+//用AES-GCM加密，返回nonce+密文，address作为附加数据，加密后的私钥不能被挪到别的地址下使用
+func sealWalletData(key, plaintext []byte, address string) []byte {
+	gcm := newWalletGCM(key)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Panic(err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, []byte(address))
+}
+
+//解密sealWalletData加密的数据，密钥不对或者数据被改过时返回ErrWrongPassphrase
+func openWalletData(key, sealed []byte, address string) ([]byte, error) {
+	gcm := newWalletGCM(key)
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(address))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func newWalletGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Panic(err)
+	}
+	return gcm
+}
+
+//钱包是否加密了
+func (ws *Wallets) IsEncrypted() bool {
+	return ws.encrypted
+}
+
+//钱包是否被锁定，加密的钱包解锁之前不能签名，也不能创建新地址
+func (ws *Wallets) IsLocked() bool {
+	return ws.encrypted && ws.key == nil
+}
+
+//用口令加密钱包，之前的明文钱包文件会被加密后的文件覆盖
+func (ws *Wallets) Encrypt(passphrase string) error {
+	if ws.encrypted {
+		return ErrWalletEncrypted
+	}
+
+	ws.setPassphrase(passphrase)
+	ws.encrypted = true
+	ws.SaveToFile()
+
+	return nil
+}
+
+//用口令解锁钱包，解出所有私钥
+func (ws *Wallets) Unlock(passphrase string) error {
+	if !ws.encrypted {
+		return ErrWalletNotEncrypted
+	}
+	return ws.unlockWithKey(deriveWalletKey(passphrase, ws.salt))
+}
+
+func (ws *Wallets) unlockWithKey(key []byte) error {
+	if _, err := openWalletData(key, ws.check, ""); err != nil {
+		return err
+	}
+
+	for address, sealed := range ws.sealed {
+		d, err := openWalletData(key, sealed, address)
+		if err != nil {
+			return err
+		}
+		ws.Wallets[address].PrivateKey = privateKeyFromD(d)
+	}
+	if ws.sealedSeed != nil {
+		seed, err := openWalletData(key, ws.sealedSeed, "seed")
+		if err != nil {
+			return err
+		}
+		ws.seed = seed
+	}
+	ws.key = key
+
+	return nil
+}
+
+//修改钱包的口令，所有私钥用新口令重新加密
+func (ws *Wallets) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	err := ws.Unlock(oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	ws.setPassphrase(newPassphrase)
+	ws.sealed = make(map[string][]byte)
+	ws.sealedSeed = nil
+	ws.SaveToFile()
+	//用旧口令解锁的状态作废
+	unlockedWallet = nil
+
+	return nil
+}
+
+//换一个新的盐，用口令推导出新的密钥
+func (ws *Wallets) setPassphrase(passphrase string) {
+	ws.salt = make([]byte, walletSalt)
+	if _, err := io.ReadFull(rand.Reader, ws.salt); err != nil {
+		log.Panic(err)
+	}
+	ws.key = deriveWalletKey(passphrase, ws.salt)
+	ws.check = sealWalletData(ws.key, walletCheckData, "")
+}
+
+//在这个进程中保持钱包解锁timeout秒，timeout为0时一直解锁到进程退出
+func (ws *Wallets) KeepUnlocked(timeout int) {
+	if ws.key == nil {
+		log.Panic(ErrWalletLocked)
+	}
+
+	var expire int64
+	if timeout > 0 {
+		expire = time.Now().Unix() + int64(timeout)
+	}
+	unlockedWallet = &walletUnlock{ws.key, expire}
+}
+
+//锁定钱包，之前walletpassphrase的解锁立即失效
+func (ws *Wallets) Lock() {
+	unlockedWallet = nil
+	if !ws.encrypted {
+		return
+	}
+	ws.key = nil
+	ws.seed = nil
+	for address := range ws.sealed {
+		ws.Wallets[address].PrivateKey = publicOnlyKey(ws.Wallets[address].PublicKey)
+	}
+}
+
+//如果这个进程中之前解锁过并且还没有过期，就直接解锁钱包
+func (ws *Wallets) loadUnlock() {
+	if unlockedWallet == nil {
+		return
+	}
+
+	expired := unlockedWallet.Expire != 0 && time.Now().Unix() >= unlockedWallet.Expire
+	if expired || ws.unlockWithKey(unlockedWallet.Key) != nil {
+		unlockedWallet = nil
+	}
+}
+
+//读取口令用的标准输入，修改口令时要连续读两行，所以只能有一个
+var stdinReader = bufio.NewReader(os.Stdin)
+
+//读取钱包口令，命令行参数没有给出时从标准输入读一行，避免口令出现在命令历史和进程列表里
+func readPassphrase(prompt, passphrase string) string {
+	if passphrase != "" {
+		return passphrase
+	}
+
+	fmt.Print(prompt)
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		log.Panic(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		log.Panic("ERROR: Passphrase can not be empty")
+	}
+
+	return line
+}